@@ -2,18 +2,25 @@
 
 select * from medicine_warehouse;
 select * from substance_warehouse;
-update substance_warehouse set total_amount=500 where total_amount!=500;
-update medicine_warehouse set total_amount=1000 where total_amount!=1000;
+-- Остатки хранятся по партиям, total_amount пересчитывается триггерами
+update substance_lot set quantity=500 where quantity!=500;
+update medicine_lot set quantity=1000 where quantity!=1000;
+select * from medicine_lot order by medicine_warehouse_id, expiration_date;
 
--- Добавление в список готового медикамента (Парацетамол)
+-- Добавление в список готового медикамента (Парацетамол): остатки не меняются
 insert into medicine_list(receipt_id, medicine_id, quantity_used) VALUES (6, 1, 900);
--- Добавление в список медикамента, изготавливаемого аптекой (Микстура от кашля)
-insert into medicine_list(receipt_id, medicine_id, quantity_used) VALUES (6, 11, 1);
--- Удаление лекарства из списка
-delete from medicine_list where receipt_id=6;
+select * from medicine_lot order by medicine_warehouse_id, expiration_date;
 
 insert into orders(customer_id, receipt_id, order_date, production_date, status)
-VALUES (5, 6, NOW(), NOW(), 'in_production');
+VALUES (5, 6, NOW(), NOW(), 'ready');
+-- Резерв под заказ увеличивает reserved_amount
+insert into stock_reservation(order_id, medicine_id, quantity)
+VALUES ((select max(id) from orders), 1, 900);
+select * from medicine_warehouse where medicine_id = 1;
+-- Выдача заказа: резерв снимается, медикамент списывается из партий по FEFO
+select consume_order_medicines((select max(id) from orders));
+select * from medicine_warehouse where medicine_id = 1;
 
+select * from medicine_lot_dispense;
 select * from medicine_usage_statistics;
 select * from substance_usage_statistics;
@@ -8,8 +8,52 @@ CREATE TYPE "medicine_type" AS ENUM (
 );
 
 CREATE TYPE "order_status" AS ENUM (
+  'accepted',
   'in_production',
-  'done'
+  'ready',
+  'picked_up',
+  'cancelled',
+  'expired'
+);
+
+CREATE TYPE "purchase_order_status" AS ENUM (
+  'draft',
+  'sent',
+  'partially_received',
+  'received'
+);
+
+CREATE TYPE "stock_movement_reason" AS ENUM (
+  'goods_receipt',
+  'write_off'
+);
+
+CREATE TYPE "write_off_reason" AS ENUM (
+  'expired',
+  'damaged',
+  'lost',
+  'recalled'
+);
+
+CREATE TYPE "notification_status" AS ENUM (
+  'pending',
+  'sent',
+  'failed'
+);
+
+CREATE TYPE "payment_method" AS ENUM (
+  'cash',
+  'card'
+);
+
+CREATE TYPE "payment_kind" AS ENUM (
+  'payment',
+  'refund'
+);
+
+CREATE TYPE "contraindication_severity" AS ENUM (
+  'warning',
+  'blocking'
 );
 
 CREATE TABLE "medicine" (
@@ -30,20 +74,23 @@ CREATE TABLE "medicine_list" (
   "id" SERIAL PRIMARY KEY,
   "receipt_id" int NOT NULL,
   "medicine_id" int NOT NULL,
-  "quantity_used" float NOT NULL
+  "quantity_used" float NOT NULL,
+  "dosage" varchar
 );
 
 CREATE TABLE "receipt" (
   "id" SERIAL PRIMARY KEY,
   "doctor_id" int NOT NULL,
-  "patient_id" int NOT NULL
+  "patient_id" int NOT NULL,
+  "issued_at" date NOT NULL DEFAULT CURRENT_DATE
 );
 
 CREATE TABLE "doctor" (
   "id" SERIAL PRIMARY KEY,
   "surname" varchar NOT NULL,
   "name" varchar NOT NULL,
-  "middle_name" varchar
+  "middle_name" varchar,
+  "active" boolean NOT NULL DEFAULT true
 );
 
 CREATE TABLE "patient" (
@@ -57,22 +104,84 @@ CREATE TABLE "patient" (
 
 CREATE TABLE "medicine_warehouse" (
   "id" SERIAL PRIMARY KEY,
-  "total_amount" int NOT NULL,
+  "total_amount" float NOT NULL DEFAULT 0,
+  "reserved_amount" float NOT NULL DEFAULT 0,
   "critical_limit" int NOT NULL,
   "medicine_id" int NOT NULL
 );
 
 CREATE TABLE "substance_warehouse" (
   "id" SERIAL PRIMARY KEY,
-  "total_amount" int NOT NULL,
+  "total_amount" float NOT NULL DEFAULT 0,
+  "reserved_amount" float NOT NULL DEFAULT 0,
   "critical_limit" int NOT NULL,
   "substance_id" int NOT NULL
 );
 
+-- Остаток строки склада хранится по партиям; total_amount равен сумме
+-- quantity её партий и поддерживается триггерами
+CREATE TABLE "medicine_lot" (
+  "id" SERIAL PRIMARY KEY,
+  "medicine_warehouse_id" int NOT NULL,
+  "lot_number" varchar NOT NULL,
+  "expiration_date" date NOT NULL,
+  "quantity" float NOT NULL CHECK ("quantity" >= 0),
+  "goods_receipt_line_id" int,
+  "received_at" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE "substance_lot" (
+  "id" SERIAL PRIMARY KEY,
+  "substance_warehouse_id" int NOT NULL,
+  "lot_number" varchar NOT NULL,
+  "expiration_date" date NOT NULL,
+  "quantity" float NOT NULL CHECK ("quantity" >= 0),
+  "goods_receipt_line_id" int,
+  "received_at" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Из каких партий выданы готовые медикаменты заказа
+CREATE TABLE "medicine_lot_dispense" (
+  "id" SERIAL PRIMARY KEY,
+  "order_id" int NOT NULL,
+  "medicine_lot_id" int NOT NULL,
+  "quantity" float NOT NULL,
+  "dispensed_at" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE "substance_lot_consumption" (
+  "id" SERIAL PRIMARY KEY,
+  "order_id" int NOT NULL,
+  "substance_lot_id" int NOT NULL,
+  "quantity" float NOT NULL,
+  "consumed_at" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
 CREATE TABLE "production_techonology" (
   "id" SERIAL PRIMARY KEY,
   "method_of_production" varchar NOT NULL,
-  "time_to_product" varchar NOT NULL
+  "time_to_product" interval NOT NULL,
+  "production_fee" float NOT NULL DEFAULT 0,
+  "shelf_life" interval NOT NULL DEFAULT '10 days'
+);
+
+CREATE TABLE "technologist" (
+  "id" SERIAL PRIMARY KEY,
+  "surname" varchar NOT NULL,
+  "name" varchar NOT NULL,
+  "middle_name" varchar,
+  "hours_per_day" interval NOT NULL DEFAULT '8 hours',
+  "active" boolean NOT NULL DEFAULT true
+);
+
+CREATE TABLE "production_slot" (
+  "id" SERIAL PRIMARY KEY,
+  "order_id" int NOT NULL,
+  "medicine_id" int NOT NULL,
+  "technologist_id" int NOT NULL,
+  "starts_at" timestamp NOT NULL,
+  "ends_at" timestamp NOT NULL,
+  CHECK ("ends_at" > "starts_at")
 );
 
 CREATE TABLE "customer" (
@@ -90,7 +199,30 @@ CREATE TABLE "orders" (
   "receipt_id" int NOT NULL,
   "order_date" date NOT NULL,
   "production_date" timestamp NOT NULL,
-  "status" order_status NOT NULL
+  "status" order_status NOT NULL,
+  "approved_by" varchar,
+  "picked_up_at" timestamp,
+  "picked_up_by" varchar,
+  "production_error" varchar
+);
+
+CREATE TABLE "stock_reservation" (
+  "id" SERIAL PRIMARY KEY,
+  "order_id" int NOT NULL,
+  "medicine_id" int,
+  "substance_id" int,
+  "quantity" float NOT NULL,
+  "created_at" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  CHECK (("medicine_id" IS NULL) <> ("substance_id" IS NULL))
+);
+
+CREATE TABLE "order_status_history" (
+  "id" SERIAL PRIMARY KEY,
+  "order_id" int NOT NULL,
+  "old_status" order_status,
+  "new_status" order_status NOT NULL,
+  "changed_at" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  "changed_by" varchar NOT NULL
 );
 
 CREATE TABLE "medicine_composition" (
@@ -111,6 +243,168 @@ CREATE TABLE "local_medicine" (
   "production_techology" int NOT NULL
 );
 
+CREATE TABLE "supplier" (
+  "id" SERIAL PRIMARY KEY,
+  "name" varchar NOT NULL,
+  "phone_number" varchar,
+  "email" varchar,
+  "address" varchar
+);
+
+CREATE TABLE "purchase_order" (
+  "id" SERIAL PRIMARY KEY,
+  "supplier_id" int NOT NULL,
+  "status" purchase_order_status NOT NULL DEFAULT 'draft',
+  "created_at" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  "created_by" varchar NOT NULL,
+  "sent_at" timestamp,
+  "received_at" timestamp
+);
+
+CREATE TABLE "purchase_order_line" (
+  "id" SERIAL PRIMARY KEY,
+  "purchase_order_id" int NOT NULL,
+  "medicine_warehouse_id" int,
+  "substance_warehouse_id" int,
+  "quantity" float NOT NULL CHECK ("quantity" > 0),
+  "received_quantity" float NOT NULL DEFAULT 0,
+  "price" float,
+  CHECK (("medicine_warehouse_id" IS NULL) <> ("substance_warehouse_id" IS NULL))
+);
+
+CREATE TABLE "goods_receipt" (
+  "id" SERIAL PRIMARY KEY,
+  "supplier_id" int NOT NULL,
+  "received_at" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  "received_by" varchar NOT NULL
+);
+
+CREATE TABLE "goods_receipt_line" (
+  "id" SERIAL PRIMARY KEY,
+  "goods_receipt_id" int NOT NULL,
+  "purchase_order_line_id" int,
+  "medicine_warehouse_id" int,
+  "substance_warehouse_id" int,
+  "lot_number" varchar NOT NULL,
+  "quantity" float NOT NULL CHECK ("quantity" > 0),
+  "unit_cost" float NOT NULL,
+  "expiration_date" date NOT NULL,
+  CHECK (("medicine_warehouse_id" IS NULL) <> ("substance_warehouse_id" IS NULL))
+);
+
+-- Списание партии: не выдача по рецепту, в *_usage_statistics не попадает
+CREATE TABLE "write_off" (
+  "id" SERIAL PRIMARY KEY,
+  "medicine_lot_id" int,
+  "substance_lot_id" int,
+  "quantity" float NOT NULL CHECK ("quantity" > 0),
+  "reason" write_off_reason NOT NULL,
+  "comment" varchar,
+  "written_off_at" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  "written_off_by" varchar NOT NULL,
+  CHECK (("medicine_lot_id" IS NULL) <> ("substance_lot_id" IS NULL))
+);
+
+-- Журнал движения остатков, кроме выдачи по рецептам
+-- (она учитывается в *_usage_statistics)
+CREATE TABLE "stock_movement" (
+  "id" SERIAL PRIMARY KEY,
+  "medicine_id" int,
+  "substance_id" int,
+  "quantity" float NOT NULL,
+  "reason" stock_movement_reason NOT NULL,
+  "goods_receipt_line_id" int,
+  "write_off_id" int,
+  "created_at" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  CHECK (("medicine_id" IS NULL) <> ("substance_id" IS NULL))
+);
+
+-- Исходящие уведомления покупателям (transactional outbox): строка пишется
+-- в той же транзакции, что и смена статуса заказа, а отправляет её диспетчер
+CREATE TABLE "notification_outbox" (
+  "id" SERIAL PRIMARY KEY,
+  "order_id" int NOT NULL,
+  "channel" varchar NOT NULL,
+  "recipient" varchar NOT NULL,
+  "message" text NOT NULL,
+  "status" notification_status NOT NULL DEFAULT 'pending',
+  "attempts" int NOT NULL DEFAULT 0,
+  "next_attempt_at" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  "last_error" varchar,
+  "created_at" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  "sent_at" timestamp
+);
+
+-- Противопоказание относится к веществу или к типу лекарства. Оно срабатывает,
+-- если диагноз пациента совпадает с diagnosis и (или) возраст выходит за
+-- пределы min_age..max_age; незаданные условия не проверяются
+CREATE TABLE "contraindication" (
+  "id" SERIAL PRIMARY KEY,
+  "substance_id" int,
+  "medicine_type" medicine_type,
+  "diagnosis" varchar,
+  "min_age" int,
+  "max_age" int,
+  "severity" contraindication_severity NOT NULL DEFAULT 'warning',
+  "note" varchar,
+  CHECK (("substance_id" IS NULL) <> ("medicine_type" IS NULL)),
+  CHECK ("diagnosis" IS NOT NULL OR "min_age" IS NOT NULL OR "max_age" IS NOT NULL)
+);
+
+CREATE TABLE "patient_allergy" (
+  "id" SERIAL PRIMARY KEY,
+  "patient_id" int NOT NULL,
+  "substance_id" int NOT NULL,
+  "reaction" varchar,
+  "noted_at" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE ("patient_id", "substance_id")
+);
+
+-- Фармацевт подтвердил, что видел аллергию пациента на вещество в составе
+-- лекарства заказа
+CREATE TABLE "allergy_acknowledgement" (
+  "id" SERIAL PRIMARY KEY,
+  "order_id" int NOT NULL,
+  "patient_allergy_id" int NOT NULL,
+  "medicine_id" int NOT NULL,
+  "acknowledged_by" varchar NOT NULL,
+  "acknowledged_at" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Счёт фиксируется, когда заказ становится готовым; до этого сумма
+-- рассчитывается по текущим ценам
+CREATE TABLE "invoice" (
+  "id" SERIAL PRIMARY KEY,
+  "order_id" int NOT NULL UNIQUE,
+  "goods_total" float NOT NULL,
+  "production_total" float NOT NULL,
+  "total" float NOT NULL,
+  "issued_at" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE "invoice_line" (
+  "id" SERIAL PRIMARY KEY,
+  "invoice_id" int NOT NULL,
+  "medicine_id" int NOT NULL,
+  "quantity" float NOT NULL,
+  "unit_price" float NOT NULL,
+  "production_fee" float NOT NULL,
+  "amount" float NOT NULL
+);
+
+-- Оплаты (в том числе предоплата) и возвраты по заказу; amount всегда
+-- положителен, направление задаёт kind
+CREATE TABLE "payment" (
+  "id" SERIAL PRIMARY KEY,
+  "order_id" int NOT NULL,
+  "kind" payment_kind NOT NULL DEFAULT 'payment',
+  "method" payment_method NOT NULL,
+  "amount" float NOT NULL CHECK ("amount" > 0),
+  "paid_at" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  "cashier" varchar NOT NULL,
+  "comment" varchar
+);
+
 CREATE TABLE "medicine_usage_statistics" (
   "id" SERIAL PRIMARY KEY,
   "medicine_id" int NOT NULL,
@@ -154,3 +448,114 @@ ALTER TABLE "local_medicine" ADD FOREIGN KEY ("production_techology") REFERENCES
 ALTER TABLE "medicine_usage_statistics" ADD FOREIGN KEY ("medicine_id") REFERENCES "medicine" ("id");
 
 ALTER TABLE "substance_usage_statistics" ADD FOREIGN KEY ("substance_id") REFERENCES "substance" ("id");
+
+ALTER TABLE "stock_reservation" ADD FOREIGN KEY ("order_id") REFERENCES "orders" ("id") ON DELETE CASCADE;
+
+ALTER TABLE "stock_reservation" ADD FOREIGN KEY ("medicine_id") REFERENCES "medicine" ("id");
+
+ALTER TABLE "stock_reservation" ADD FOREIGN KEY ("substance_id") REFERENCES "substance" ("id");
+
+-- История статусов - журнал аудита: заказ с историей не удаляется, а отменяется
+ALTER TABLE "order_status_history" ADD FOREIGN KEY ("order_id") REFERENCES "orders" ("id");
+
+ALTER TABLE "production_slot" ADD FOREIGN KEY ("order_id") REFERENCES "orders" ("id") ON DELETE CASCADE;
+
+ALTER TABLE "production_slot" ADD FOREIGN KEY ("medicine_id") REFERENCES "medicine" ("id");
+
+ALTER TABLE "production_slot" ADD FOREIGN KEY ("technologist_id") REFERENCES "technologist" ("id");
+
+ALTER TABLE "purchase_order" ADD FOREIGN KEY ("supplier_id") REFERENCES "supplier" ("id");
+
+ALTER TABLE "purchase_order_line" ADD FOREIGN KEY ("purchase_order_id") REFERENCES "purchase_order" ("id") ON DELETE CASCADE;
+
+ALTER TABLE "purchase_order_line" ADD FOREIGN KEY ("medicine_warehouse_id") REFERENCES "medicine_warehouse" ("id");
+
+ALTER TABLE "purchase_order_line" ADD FOREIGN KEY ("substance_warehouse_id") REFERENCES "substance_warehouse" ("id");
+
+ALTER TABLE "goods_receipt" ADD FOREIGN KEY ("supplier_id") REFERENCES "supplier" ("id");
+
+ALTER TABLE "goods_receipt_line" ADD FOREIGN KEY ("goods_receipt_id") REFERENCES "goods_receipt" ("id");
+
+ALTER TABLE "goods_receipt_line" ADD FOREIGN KEY ("purchase_order_line_id") REFERENCES "purchase_order_line" ("id");
+
+ALTER TABLE "goods_receipt_line" ADD FOREIGN KEY ("medicine_warehouse_id") REFERENCES "medicine_warehouse" ("id");
+
+ALTER TABLE "goods_receipt_line" ADD FOREIGN KEY ("substance_warehouse_id") REFERENCES "substance_warehouse" ("id");
+
+ALTER TABLE "stock_movement" ADD FOREIGN KEY ("medicine_id") REFERENCES "medicine" ("id");
+
+ALTER TABLE "stock_movement" ADD FOREIGN KEY ("substance_id") REFERENCES "substance" ("id");
+
+ALTER TABLE "stock_movement" ADD FOREIGN KEY ("goods_receipt_line_id") REFERENCES "goods_receipt_line" ("id");
+
+ALTER TABLE "medicine_lot" ADD FOREIGN KEY ("medicine_warehouse_id") REFERENCES "medicine_warehouse" ("id");
+
+ALTER TABLE "medicine_lot" ADD FOREIGN KEY ("goods_receipt_line_id") REFERENCES "goods_receipt_line" ("id");
+
+ALTER TABLE "substance_lot" ADD FOREIGN KEY ("substance_warehouse_id") REFERENCES "substance_warehouse" ("id");
+
+ALTER TABLE "substance_lot" ADD FOREIGN KEY ("goods_receipt_line_id") REFERENCES "goods_receipt_line" ("id");
+
+ALTER TABLE "medicine_lot_dispense" ADD FOREIGN KEY ("order_id") REFERENCES "orders" ("id");
+
+ALTER TABLE "medicine_lot_dispense" ADD FOREIGN KEY ("medicine_lot_id") REFERENCES "medicine_lot" ("id");
+
+ALTER TABLE "substance_lot_consumption" ADD FOREIGN KEY ("order_id") REFERENCES "orders" ("id") ON DELETE CASCADE;
+
+ALTER TABLE "substance_lot_consumption" ADD FOREIGN KEY ("substance_lot_id") REFERENCES "substance_lot" ("id");
+
+ALTER TABLE "write_off" ADD FOREIGN KEY ("medicine_lot_id") REFERENCES "medicine_lot" ("id");
+
+ALTER TABLE "write_off" ADD FOREIGN KEY ("substance_lot_id") REFERENCES "substance_lot" ("id");
+
+ALTER TABLE "stock_movement" ADD FOREIGN KEY ("write_off_id") REFERENCES "write_off" ("id");
+
+ALTER TABLE "notification_outbox" ADD FOREIGN KEY ("order_id") REFERENCES "orders" ("id") ON DELETE CASCADE;
+
+ALTER TABLE "contraindication" ADD FOREIGN KEY ("substance_id") REFERENCES "substance" ("id");
+
+ALTER TABLE "patient_allergy" ADD FOREIGN KEY ("patient_id") REFERENCES "patient" ("id") ON DELETE CASCADE;
+
+ALTER TABLE "patient_allergy" ADD FOREIGN KEY ("substance_id") REFERENCES "substance" ("id");
+
+ALTER TABLE "allergy_acknowledgement" ADD FOREIGN KEY ("order_id") REFERENCES "orders" ("id") ON DELETE CASCADE;
+
+ALTER TABLE "allergy_acknowledgement" ADD FOREIGN KEY ("patient_allergy_id") REFERENCES "patient_allergy" ("id") ON DELETE RESTRICT;
+
+ALTER TABLE "allergy_acknowledgement" ADD FOREIGN KEY ("medicine_id") REFERENCES "medicine" ("id");
+
+ALTER TABLE "invoice" ADD FOREIGN KEY ("order_id") REFERENCES "orders" ("id") ON DELETE CASCADE;
+
+ALTER TABLE "invoice_line" ADD FOREIGN KEY ("invoice_id") REFERENCES "invoice" ("id") ON DELETE CASCADE;
+
+ALTER TABLE "invoice_line" ADD FOREIGN KEY ("medicine_id") REFERENCES "medicine" ("id");
+
+ALTER TABLE "payment" ADD FOREIGN KEY ("order_id") REFERENCES "orders" ("id");
+
+-- Цена строк рецепта по текущим ценам - единственное место расчёта цены:
+-- по нему считается счёт заказа и отчёт о неоплаченных заказах. Цена единицы
+-- готового лекарства - medicine.price, аптечного изготовления - стоимость
+-- веществ по medicine_composition; плата за изготовление берётся один раз на
+-- строку. Цена единицы и сумма строки округляются до копеек
+CREATE VIEW "receipt_line_price" AS
+SELECT ml.id            AS medicine_list_id,
+       ml.receipt_id,
+       ml.medicine_id,
+       ml.quantity_used AS quantity,
+       price.unit_price,
+       price.production_fee,
+       ROUND((price.unit_price * ml.quantity_used + price.production_fee)::numeric, 2)::float AS amount
+FROM medicine_list ml
+         CROSS JOIN LATERAL (
+             SELECT ROUND((CASE WHEN lm.id IS NULL THEN m.price
+                                ELSE (SELECT COALESCE(SUM(mc.required_quantity * s.price), 0)
+                                      FROM medicine_composition mc
+                                               JOIN substance s ON s.id = mc.substance_id
+                                      WHERE mc.medicine_id = lm.id)
+                               END)::numeric, 2)::float AS unit_price,
+                    COALESCE(pt.production_fee, 0) AS production_fee
+             FROM medicine m
+                      LEFT JOIN local_medicine lm ON lm.medicine_id = m.id
+                      LEFT JOIN production_techonology pt ON pt.id = lm.production_techology
+             WHERE m.id = ml.medicine_id
+             ) price;
@@ -1,93 +1,324 @@
-CREATE OR REPLACE FUNCTION decrease_medicine_and_substance_stock() RETURNS TRIGGER AS $$
-DECLARE
-    rec RECORD;
-    local_medicine_id INT;
+-- Рецепт сам по себе остатки не меняет: готовые медикаменты резервируются
+-- при оформлении заказа и списываются из партий при его выдаче
+-- (consume_order_medicines), вещества для лекарств аптечного изготовления -
+-- по завершении изготовления (consume_order_substances)
+
+
+-- Резервирование остатков под заказ: доступный остаток = непросроченные
+-- партии - reserved_amount
+CREATE OR REPLACE FUNCTION reserve_stock() RETURNS TRIGGER AS $$
 BEGIN
-    SELECT id INTO local_medicine_id FROM local_medicine WHERE medicine_id = NEW.medicine_id;
+    IF NEW.medicine_id IS NOT NULL THEN
+        UPDATE medicine_warehouse
+        SET reserved_amount = reserved_amount + NEW.quantity
+        WHERE medicine_id = NEW.medicine_id;
+    ELSE
+        UPDATE substance_warehouse
+        SET reserved_amount = reserved_amount + NEW.quantity
+        WHERE substance_id = NEW.substance_id;
+    END IF;
 
-    -- Уменьшение количества медикаментов на складе
-    UPDATE medicine_warehouse
-    SET total_amount = total_amount - NEW.quantity_used
-    WHERE medicine_id = NEW.medicine_id;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
 
-    -- Проверка критического уровня медикаментов
-    IF (SELECT total_amount FROM medicine_warehouse WHERE medicine_id = NEW.medicine_id) < (SELECT critical_limit FROM medicine_warehouse WHERE medicine_id = NEW.medicine_id) THEN
-        RAISE NOTICE 'Critical limit reached for medicine_id %', NEW.medicine_id;
+
+-- Снятие резерва при отмене заказа или его удалении (ON DELETE CASCADE)
+CREATE OR REPLACE FUNCTION release_stock() RETURNS TRIGGER AS $$
+BEGIN
+    IF OLD.medicine_id IS NOT NULL THEN
+        UPDATE medicine_warehouse
+        SET reserved_amount = reserved_amount - OLD.quantity
+        WHERE medicine_id = OLD.medicine_id;
+    ELSE
+        UPDATE substance_warehouse
+        SET reserved_amount = reserved_amount - OLD.quantity
+        WHERE substance_id = OLD.substance_id;
     END IF;
 
-    -- Уменьшение количества ингредиентов на складе на основе состава медикамента
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_reserve_stock
+    AFTER INSERT ON stock_reservation
+    FOR EACH ROW
+EXECUTE FUNCTION reserve_stock();
+
+
+CREATE TRIGGER trg_release_stock
+    AFTER DELETE ON stock_reservation
+    FOR EACH ROW
+EXECUTE FUNCTION release_stock();
+
+
+-- Списание веществ, зарезервированных под изготовление заказа:
+-- резерв снимается (trg_release_stock), вещества берутся из партий по FEFO.
+-- Просроченные партии не используются; если непросроченных не хватает,
+-- изготовление не может быть завершено
+CREATE OR REPLACE FUNCTION consume_order_substances(p_order_id INT) RETURNS VOID AS $$
+DECLARE
+    rec RECORD;
+    lot RECORD;
+    remaining FLOAT;
+    taken FLOAT;
+BEGIN
     FOR rec IN
-        SELECT substance_id, required_quantity
-        FROM medicine_composition
-        WHERE medicine_id = local_medicine_id
+        DELETE FROM stock_reservation
+        WHERE order_id = p_order_id AND substance_id IS NOT NULL
+        RETURNING substance_id, quantity
         LOOP
-            UPDATE substance_warehouse
-            SET total_amount = total_amount - (rec.required_quantity * NEW.quantity_used)
-            WHERE substance_id = rec.substance_id;
+            remaining := rec.quantity;
+            FOR lot IN
+                SELECT sl.id, sl.quantity
+                FROM substance_lot sl
+                         JOIN substance_warehouse sw ON sw.id = sl.substance_warehouse_id
+                WHERE sw.substance_id = rec.substance_id
+                  AND sl.quantity > 0
+                  AND sl.expiration_date >= CURRENT_DATE
+                ORDER BY sl.expiration_date, sl.id
+                FOR UPDATE OF sl
+                LOOP
+                    EXIT WHEN remaining <= 0;
+                    taken := LEAST(remaining, lot.quantity);
 
-            -- Проверка критического уровня ингредиентов
-            IF (SELECT total_amount FROM substance_warehouse WHERE substance_id = rec.substance_id) < (SELECT critical_limit FROM substance_warehouse WHERE substance_id = rec.substance_id) THEN
-                RAISE NOTICE 'Critical limit reached for substance_id %', rec.substance_id;
+                    UPDATE substance_lot SET quantity = quantity - taken WHERE id = lot.id;
+                    INSERT INTO substance_lot_consumption (order_id, substance_lot_id, quantity)
+                    VALUES (p_order_id, lot.id, taken);
+
+                    remaining := remaining - taken;
+                END LOOP;
+
+            IF remaining > 0 THEN
+                RAISE EXCEPTION 'Not enough unexpired stock for substance_id %: % missing', rec.substance_id, remaining;
             END IF;
 
             -- Логирование использования ингредиентов
             INSERT INTO substance_usage_statistics (substance_id, quantity_used, usage_time)
-            VALUES (rec.substance_id, rec.required_quantity * NEW.quantity_used, CURRENT_TIMESTAMP);
+            VALUES (rec.substance_id, rec.quantity, CURRENT_TIMESTAMP);
         END LOOP;
+END;
+$$ LANGUAGE plpgsql;
 
-    -- Логирование использования медикаментов
-    INSERT INTO medicine_usage_statistics (medicine_id, quantity_used, usage_time)
-    VALUES (NEW.medicine_id, NEW.quantity_used, CURRENT_TIMESTAMP);
 
-    RETURN NEW;
+-- Списание готовых медикаментов, зарезервированных под заказ, при его выдаче:
+-- резерв снимается (trg_release_stock), медикаменты выдаются из партий по FEFO
+-- (первой истекает - первой выдаётся). Просроченные партии не выдаются; если
+-- непросроченных не хватает, заказ не может быть выдан
+CREATE OR REPLACE FUNCTION consume_order_medicines(p_order_id INT) RETURNS VOID AS $$
+DECLARE
+    rec RECORD;
+    lot RECORD;
+    remaining FLOAT;
+    taken FLOAT;
+BEGIN
+    FOR rec IN
+        DELETE FROM stock_reservation
+        WHERE order_id = p_order_id AND medicine_id IS NOT NULL
+        RETURNING medicine_id, quantity
+        LOOP
+            remaining := rec.quantity;
+            FOR lot IN
+                SELECT ml.id, ml.quantity
+                FROM medicine_lot ml
+                         JOIN medicine_warehouse mw ON mw.id = ml.medicine_warehouse_id
+                WHERE mw.medicine_id = rec.medicine_id
+                  AND ml.quantity > 0
+                  AND ml.expiration_date >= CURRENT_DATE
+                ORDER BY ml.expiration_date, ml.id
+                FOR UPDATE OF ml
+                LOOP
+                    EXIT WHEN remaining <= 0;
+                    taken := LEAST(remaining, lot.quantity);
+
+                    UPDATE medicine_lot SET quantity = quantity - taken WHERE id = lot.id;
+                    INSERT INTO medicine_lot_dispense (order_id, medicine_lot_id, quantity)
+                    VALUES (p_order_id, lot.id, taken);
+
+                    remaining := remaining - taken;
+                END LOOP;
+
+            IF remaining > 0 THEN
+                RAISE EXCEPTION 'Not enough unexpired stock for medicine_id %: % missing', rec.medicine_id, remaining;
+            END IF;
+
+            -- О достижении критического уровня сообщает trg_notify_medicine_stock
+
+            -- Логирование использования медикаментов
+            INSERT INTO medicine_usage_statistics (medicine_id, quantity_used, usage_time)
+            VALUES (rec.medicine_id, rec.quantity, CURRENT_TIMESTAMP);
+        END LOOP;
 END;
 $$ LANGUAGE plpgsql;
 
 
-CREATE OR REPLACE FUNCTION increase_medicine_and_substance_stock() RETURNS TRIGGER AS $$
+-- Приход по приёмке: поступившая партия заводится на склад (остаток строки
+-- склада увеличивает trg_sync_*_lot_total), движение записывается в stock_movement
+CREATE OR REPLACE FUNCTION book_goods_receipt_line() RETURNS TRIGGER AS $$
 DECLARE
-    rec RECORD;
-    local_medicine_id INT;
+    v_medicine_id INT;
+    v_substance_id INT;
 BEGIN
-    -- Найти соответствующий local_medicine для medicine_id
-    SELECT id INTO local_medicine_id FROM local_medicine WHERE medicine_id = OLD.medicine_id;
+    IF NEW.medicine_warehouse_id IS NOT NULL THEN
+        INSERT INTO medicine_lot (medicine_warehouse_id, lot_number, expiration_date, quantity, goods_receipt_line_id)
+        VALUES (NEW.medicine_warehouse_id, NEW.lot_number, NEW.expiration_date, NEW.quantity, NEW.id);
 
-    -- Возврат количества медикаментов на склад
+        SELECT medicine_id INTO v_medicine_id FROM medicine_warehouse WHERE id = NEW.medicine_warehouse_id;
+    ELSE
+        INSERT INTO substance_lot (substance_warehouse_id, lot_number, expiration_date, quantity, goods_receipt_line_id)
+        VALUES (NEW.substance_warehouse_id, NEW.lot_number, NEW.expiration_date, NEW.quantity, NEW.id);
+
+        SELECT substance_id INTO v_substance_id FROM substance_warehouse WHERE id = NEW.substance_warehouse_id;
+    END IF;
+
+    INSERT INTO stock_movement (medicine_id, substance_id, quantity, reason, goods_receipt_line_id)
+    VALUES (v_medicine_id, v_substance_id, NEW.quantity, 'goods_receipt', NEW.id);
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_book_goods_receipt_line
+    AFTER INSERT ON goods_receipt_line
+    FOR EACH ROW
+EXECUTE FUNCTION book_goods_receipt_line();
+
+
+-- total_amount строки склада = сумма остатков её партий
+CREATE OR REPLACE FUNCTION sync_medicine_lot_total() RETURNS TRIGGER AS $$
+BEGIN
     UPDATE medicine_warehouse
-    SET total_amount = total_amount + OLD.quantity_used
-    WHERE medicine_id = OLD.medicine_id;
+    SET total_amount = total_amount
+        + CASE WHEN TG_OP = 'DELETE' THEN 0 ELSE NEW.quantity END
+        - CASE WHEN TG_OP = 'INSERT' THEN 0 ELSE OLD.quantity END
+    WHERE id = CASE WHEN TG_OP = 'DELETE' THEN OLD.medicine_warehouse_id ELSE NEW.medicine_warehouse_id END;
 
-    -- Логирование возврата медикаментов
-    INSERT INTO medicine_usage_statistics (medicine_id, quantity_used, usage_time)
-    VALUES (OLD.medicine_id, -OLD.quantity_used, CURRENT_TIMESTAMP);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
 
-    -- Возврат количества ингредиентов на склад на основе состава медикамента
-    FOR rec IN
-        SELECT substance_id, required_quantity
-        FROM medicine_composition
-        WHERE medicine_id = local_medicine_id
-        LOOP
-            UPDATE substance_warehouse
-            SET total_amount = total_amount + (rec.required_quantity * OLD.quantity_used)
-            WHERE substance_id = rec.substance_id;
 
-            -- Логирование возврата ингредиентов
-            INSERT INTO substance_usage_statistics (substance_id, quantity_used, usage_time)
-            VALUES (rec.substance_id, -(rec.required_quantity * OLD.quantity_used), CURRENT_TIMESTAMP);
-        END LOOP;
+CREATE OR REPLACE FUNCTION sync_substance_lot_total() RETURNS TRIGGER AS $$
+BEGIN
+    UPDATE substance_warehouse
+    SET total_amount = total_amount
+        + CASE WHEN TG_OP = 'DELETE' THEN 0 ELSE NEW.quantity END
+        - CASE WHEN TG_OP = 'INSERT' THEN 0 ELSE OLD.quantity END
+    WHERE id = CASE WHEN TG_OP = 'DELETE' THEN OLD.substance_warehouse_id ELSE NEW.substance_warehouse_id END;
 
-    RETURN OLD;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_sync_medicine_lot_total
+    AFTER INSERT OR UPDATE OF quantity OR DELETE ON medicine_lot
+    FOR EACH ROW
+EXECUTE FUNCTION sync_medicine_lot_total();
+
+
+CREATE TRIGGER trg_sync_substance_lot_total
+    AFTER INSERT OR UPDATE OF quantity OR DELETE ON substance_lot
+    FOR EACH ROW
+EXECUTE FUNCTION sync_substance_lot_total();
+
+
+-- Списание уменьшает остаток партии (а через неё строки склада) и пишет
+-- отрицательное движение в stock_movement
+CREATE OR REPLACE FUNCTION book_write_off() RETURNS TRIGGER AS $$
+DECLARE
+    v_medicine_id INT;
+    v_substance_id INT;
+BEGIN
+    IF NEW.medicine_lot_id IS NOT NULL THEN
+        UPDATE medicine_lot SET quantity = quantity - NEW.quantity WHERE id = NEW.medicine_lot_id;
+
+        SELECT mw.medicine_id INTO v_medicine_id
+        FROM medicine_lot ml
+                 JOIN medicine_warehouse mw ON mw.id = ml.medicine_warehouse_id
+        WHERE ml.id = NEW.medicine_lot_id;
+    ELSE
+        UPDATE substance_lot SET quantity = quantity - NEW.quantity WHERE id = NEW.substance_lot_id;
+
+        SELECT sw.substance_id INTO v_substance_id
+        FROM substance_lot sl
+                 JOIN substance_warehouse sw ON sw.id = sl.substance_warehouse_id
+        WHERE sl.id = NEW.substance_lot_id;
+    END IF;
+
+    INSERT INTO stock_movement (medicine_id, substance_id, quantity, reason, write_off_id)
+    VALUES (v_medicine_id, v_substance_id, -NEW.quantity, 'write_off', NEW.id);
+
+    RETURN NEW;
 END;
 $$ LANGUAGE plpgsql;
 
-CREATE TRIGGER trg_decrease_medicine_and_substance_stock
-    AFTER INSERT ON medicine_list
+CREATE TRIGGER trg_book_write_off
+    AFTER INSERT ON write_off
     FOR EACH ROW
-EXECUTE FUNCTION decrease_medicine_and_substance_stock();
+EXECUTE FUNCTION book_write_off();
 
 
-CREATE TRIGGER trg_increase_medicine_and_substance_stock
-    BEFORE DELETE ON medicine_list
+-- Уведомление stock_alert (pg_notify), когда доступный остаток строки склада
+-- опускается до критической нормы (как в отчёте 6). Доступный остаток
+-- считается по непросроченным партиям за вычетом резерва. Уведомление
+-- отправляется только при переходе через норму, а не при каждом следующем
+-- списании; прежний остаток оценивается по изменению total_amount и
+-- reserved_amount, поэтому списание просроченной партии может повторить
+-- уже отправленное уведомление.
+CREATE OR REPLACE FUNCTION notify_critical_stock() RETURNS TRIGGER AS $$
+DECLARE
+    v_item_id INT;
+    v_name VARCHAR;
+    v_unexpired FLOAT;
+    v_available FLOAT;
+    v_old_available FLOAT;
+BEGIN
+    IF TG_TABLE_NAME = 'medicine_warehouse' THEN
+        SELECT COALESCE(SUM(quantity), 0) INTO v_unexpired
+        FROM medicine_lot
+        WHERE medicine_warehouse_id = NEW.id AND expiration_date >= CURRENT_DATE;
+    ELSE
+        SELECT COALESCE(SUM(quantity), 0) INTO v_unexpired
+        FROM substance_lot
+        WHERE substance_warehouse_id = NEW.id AND expiration_date >= CURRENT_DATE;
+    END IF;
+    v_available := v_unexpired - NEW.reserved_amount;
+    v_old_available := v_available - (NEW.total_amount - OLD.total_amount)
+                                   + (NEW.reserved_amount - OLD.reserved_amount);
+
+    IF v_available > NEW.critical_limit OR v_old_available <= OLD.critical_limit THEN
+        RETURN NULL;
+    END IF;
+
+    IF TG_TABLE_NAME = 'medicine_warehouse' THEN
+        v_item_id := NEW.medicine_id;
+        SELECT name INTO v_name FROM medicine WHERE id = v_item_id;
+    ELSE
+        v_item_id := NEW.substance_id;
+        SELECT name INTO v_name FROM substance WHERE id = v_item_id;
+    END IF;
+
+    PERFORM pg_notify('stock_alert', json_build_object(
+        'kind', CASE WHEN TG_TABLE_NAME = 'medicine_warehouse' THEN 'medicine' ELSE 'substance' END,
+        'warehouse_id', NEW.id,
+        'item_id', v_item_id,
+        'name', v_name,
+        'available_amount', v_available,
+        'critical_limit', NEW.critical_limit,
+        'at', to_char(CURRENT_TIMESTAMP, 'YYYY-MM-DD HH24:MI:SS')
+    )::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_notify_medicine_stock
+    AFTER UPDATE OF total_amount, reserved_amount, critical_limit ON medicine_warehouse
     FOR EACH ROW
-EXECUTE FUNCTION increase_medicine_and_substance_stock();
+EXECUTE FUNCTION notify_critical_stock();
 
+
+CREATE TRIGGER trg_notify_substance_stock
+    AFTER UPDATE OF total_amount, reserved_amount, critical_limit ON substance_warehouse
+    FOR EACH ROW
+EXECUTE FUNCTION notify_critical_stock();
@@ -32,12 +32,16 @@ INSERT INTO substance (id, name, price) VALUES
 (14, 'Сахар', 1.0),
 (15, 'Вода', 0.5);
 
-INSERT INTO production_techonology (id, method_of_production, time_to_product) VALUES
-(1, 'Смешивание и фильтрация ингредиентов для микстуры', '2 часа'),
-(2, 'Смешивание ингредиентов для мази', '1 час'),
-(3, 'Смешивание и фильтрация ингредиентов для раствора', '3 часа'),
-(4, 'Смешивание ингредиентов для настойки', '2 часа'),
-(5, 'Смешивание ингредиентов для порошка', '1 час');
+INSERT INTO production_techonology (id, method_of_production, time_to_product, production_fee, shelf_life) VALUES
+(1, 'Смешивание и фильтрация ингредиентов для микстуры', '2 hours', 150.0, '10 days'),
+(2, 'Смешивание ингредиентов для мази', '1 hour', 100.0, '30 days'),
+(3, 'Смешивание и фильтрация ингредиентов для раствора', '3 hours', 200.0, '2 days'),
+(4, 'Смешивание ингредиентов для настойки', '2 hours', 150.0, '30 days'),
+(5, 'Смешивание ингредиентов для порошка', '1 hour', 80.0, '90 days');
+
+INSERT INTO technologist (id, surname, name, middle_name, hours_per_day) VALUES
+(1, 'Орлова', 'Ирина', 'Владимировна', '8 hours'),
+(2, 'Лебедев', 'Сергей', 'Николаевич', '4 hours');
 
 INSERT INTO local_medicine (id, medicine_id, type, production_techology) VALUES
 (1, 11, 'mixture', 1),
@@ -89,11 +93,11 @@ INSERT INTO receipt (id, doctor_id, patient_id) VALUES
 (5, 5, 5);  -- Рецепт от доктора Волкова для пациента Кузнецова Алексея
 
 INSERT INTO "order" (id, customer_id, receipt_id, order_date, production_date, status) VALUES
-(1, 1, 1, '2024-05-01', '2024-05-03', 'done'),       -- Заказ от клиента Иванова на рецепт 1
+(1, 1, 1, '2024-05-01', '2024-05-03', 'ready'),      -- Заказ от клиента Иванова на рецепт 1
 (2, 2, 2, '2024-05-02', '2024-05-04', 'in_production'), -- Заказ от клиента Петрова на рецепт 2
-(3, 3, 3, '2024-05-03', '2024-05-05', 'done'),       -- Заказ от клиента Сидорова на рецепт 3
+(3, 3, 3, '2024-05-03', '2024-05-05', 'ready'),      -- Заказ от клиента Сидорова на рецепт 3
 (4, 4, 4, '2024-05-04', '2024-05-06', 'in_production'), -- Заказ от клиента Смирновой на рецепт 4
-(5, 5, 5, '2024-05-05', '2024-05-07', 'done');       -- Заказ от клиента Кузнецовой на рецепт 5
+(5, 5, 5, '2024-05-05', '2024-05-07', 'ready');      -- Заказ от клиента Кузнецовой на рецепт 5
 
 INSERT INTO imported_medicine (id, medicine_id, type) VALUES
 (1, 1, 'pill'),          -- Парацетамол
@@ -107,14 +111,40 @@ INSERT INTO imported_medicine (id, medicine_id, type) VALUES
 (9, 9, 'solution'),      -- Перекись водорода
 (10, 10, 'pill');        -- Поливитамины
 
-INSERT INTO medicine_warehouse (id, total_amount, critical_limit, medicine_id)
-SELECT m.id, 1000, 100, m.id
+INSERT INTO medicine_warehouse (id, critical_limit, medicine_id)
+SELECT m.id, 100, m.id
 FROM medicine m;
 
-INSERT INTO substance_warehouse (id, total_amount, critical_limit, substance_id)
-SELECT s.id, 500, 50, s.id
+INSERT INTO substance_warehouse (id, critical_limit, substance_id)
+SELECT s.id, 50, s.id
 FROM substance s;
 
+-- Начальные остатки заводятся партиями; total_amount пересчитывают триггеры
+INSERT INTO medicine_lot (medicine_warehouse_id, lot_number, expiration_date, quantity)
+SELECT mw.id, 'INIT-M' || mw.id, m.expiration_date, 1000
+FROM medicine_warehouse mw
+         JOIN medicine m ON m.id = mw.medicine_id;
+
+INSERT INTO substance_lot (substance_warehouse_id, lot_number, expiration_date, quantity)
+SELECT sw.id, 'INIT-S' || sw.id, CURRENT_DATE + INTERVAL '2 years', 500
+FROM substance_warehouse sw;
+
+INSERT INTO supplier (id, name, phone_number, email, address) VALUES
+(1, 'ФармДистрибуция', '+7 383 200-10-10', 'order@pharmdistr.ru', 'Новосибирск, ул. Станционная, 30'),
+(2, 'ХимРеактив', '+7 383 200-20-20', 'sales@himreaktiv.ru', 'Новосибирск, ул. Тихая, 5');
+
+INSERT INTO contraindication (id, substance_id, medicine_type, diagnosis, min_age, max_age, severity, note) VALUES
+(1, 12, NULL, 'Грипп', NULL, NULL, 'blocking', 'Аспирин при гриппе: риск синдрома Рея'),
+(2, 1, NULL, 'Грипп', NULL, NULL, 'blocking', 'Ацетилсалициловая кислота при гриппе: риск синдрома Рея'),
+(3, 3, NULL, NULL, 12, NULL, 'blocking', 'Кофеин не назначается детям до 12 лет'),
+(4, 6, NULL, 'Ангина', NULL, NULL, 'warning', 'Уточнить переносимость пенициллинов'),
+(5, NULL, 'tincture', NULL, 18, NULL, 'warning', 'Спиртовая настойка: с осторожностью до 18 лет'),
+(6, 14, NULL, 'Сахарный диабет', NULL, NULL, 'warning', 'Содержит сахар');
+
+INSERT INTO patient_allergy (id, patient_id, substance_id, reaction) VALUES
+(1, 3, 13, 'Крапивница'),
+(2, 5, 2, 'Отёк Квинке');
+
 INSERT INTO medicine_list (id, receipt_id, medicine_id, quantity_used)
 VALUES
 (1, 1, 1, 2.5),   -- Пример: 2.5 единицы медикамента 1 в чеке 1
@@ -1,15 +1,20 @@
 -- 1. Получить сведения о покупателях, которые не пришли забрать свой заказ в назначенное им время и общее их число.
-SELECT customer.*, orders.*
+SELECT customer.*,
+       orders.*,
+       COALESCE(orders.picked_up_at::date, CURRENT_DATE) - orders.production_date::date AS days_overdue
 FROM customer
          JOIN orders ON customer.id = orders.customer_id
-WHERE orders.status = 'done'
-  AND orders.production_date < CURRENT_DATE;
+WHERE (orders.status IN ('ready', 'expired') AND orders.picked_up_at IS NULL
+    AND orders.production_date::date < CURRENT_DATE)
+   OR orders.picked_up_at::date > orders.production_date::date
+ORDER BY days_overdue DESC;
 
 SELECT COUNT(DISTINCT customer.id)
 FROM customer
          JOIN orders ON customer.id = orders.customer_id
-WHERE orders.status = 'done'
-  AND orders.production_date < CURRENT_DATE;
+WHERE (orders.status IN ('ready', 'expired') AND orders.picked_up_at IS NULL
+    AND orders.production_date::date < CURRENT_DATE)
+   OR orders.picked_up_at::date > orders.production_date::date;
 
 -- 2. Получить перечень и общее число покупателей,
 -- которые ждут прибытия на склад нужных им медикаментов в целом
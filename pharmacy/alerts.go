@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// stockAlertChannel - канал pg_notify, в который пишет триггер notify_critical_stock
+const stockAlertChannel = "stock_alert"
+
+// alertReconnectDelay - пауза перед повторным LISTEN после потери соединения
+const alertReconnectDelay = 5 * time.Second
+
+// alertHeartbeat - как часто в поток SSE пишется комментарий, чтобы прокси
+// не закрывали простаивающее соединение
+const alertHeartbeat = 30 * time.Second
+
+type StockAlert struct {
+	Kind            string  `json:"kind"`
+	WarehouseID     int     `json:"warehouse_id"`
+	ItemID          int     `json:"item_id"`
+	Name            string  `json:"name"`
+	AvailableAmount float64 `json:"available_amount"`
+	CriticalLimit   float64 `json:"critical_limit"`
+	At              string  `json:"at"`
+}
+
+// alertHub рассылает уведомления всем подписчикам потока /alerts/stream.
+// Медленный подписчик не задерживает остальных: если его буфер полон,
+// уведомление для него отбрасывается.
+type alertHub struct {
+	mu          sync.Mutex
+	subscribers map[chan StockAlert]struct{}
+}
+
+var alerts = &alertHub{subscribers: make(map[chan StockAlert]struct{})}
+
+func (h *alertHub) subscribe() chan StockAlert {
+	ch := make(chan StockAlert, 16)
+	h.mu.Lock()
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *alertHub) unsubscribe(ch chan StockAlert) {
+	h.mu.Lock()
+	delete(h.subscribers, ch)
+	h.mu.Unlock()
+}
+
+func (h *alertHub) publish(alert StockAlert) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- alert:
+		default:
+		}
+	}
+}
+
+// listenStockAlerts держит отдельное соединение с LISTEN stock_alert и
+// публикует полученные уведомления, пока не отменён ctx. При обрыве
+// соединения подписка восстанавливается.
+func listenStockAlerts(ctx context.Context) {
+	for {
+		err := listenStockAlertsOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Stock alert listener error: %v, reconnecting in %s\n", err, alertReconnectDelay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(alertReconnectDelay):
+		}
+	}
+}
+
+func listenStockAlertsOnce(ctx context.Context) error {
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+stockAlertChannel); err != nil {
+		return err
+	}
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var alert StockAlert
+		if err := json.Unmarshal([]byte(notification.Payload), &alert); err != nil {
+			log.Printf("Invalid stock alert payload %q: %v\n", notification.Payload, err)
+			continue
+		}
+		alerts.publish(alert)
+	}
+}
+
+// streamAlertsHandler отдаёт уведомления о критическом остатке потоком
+// Server-Sent Events (событие stock_alert с JSON StockAlert в data).
+func streamAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := alerts.subscribe()
+	defer alerts.unsubscribe(ch)
+
+	heartbeat := time.NewTicker(alertHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case alert := <-ch:
+			data, err := json.Marshal(alert)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", stockAlertChannel, data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type PatientAllergy struct {
+	ID            int     `json:"id"`
+	PatientID     int     `json:"patient_id"`
+	SubstanceID   int     `json:"substance_id"`
+	SubstanceName string  `json:"substance_name"`
+	Reaction      *string `json:"reaction"`
+	NotedAt       string  `json:"noted_at"`
+}
+
+// AllergyWarning - лекарство рецепта содержит вещество, на которое у
+// пациента аллергия. Заказ по такому рецепту принимается, только если
+// фармацевт подтвердил каждое предупреждение (acknowledged_allergies).
+type AllergyWarning struct {
+	AllergyID   int    `json:"allergy_id"`
+	MedicineID  int    `json:"medicine_id"`
+	SubstanceID int    `json:"substance_id"`
+	Message     string `json:"message"`
+}
+
+// checkAllergies раскрывает строки рецепта через medicine_composition и
+// сверяет вещества с аллергиями пациента.
+func checkAllergies(ctx context.Context, q querier, receiptID int) ([]AllergyWarning, error) {
+	rows, err := q.Query(ctx, `
+		SELECT DISTINCT pa.id, m.id, s.id, m.name, s.name, pa.reaction
+		FROM receipt r
+		JOIN medicine_list ml ON ml.receipt_id = r.id
+		JOIN medicine m ON m.id = ml.medicine_id
+		JOIN local_medicine lm ON lm.medicine_id = m.id
+		JOIN medicine_composition mc ON mc.medicine_id = lm.id
+		JOIN patient_allergy pa ON pa.patient_id = r.patient_id AND pa.substance_id = mc.substance_id
+		JOIN substance s ON s.id = pa.substance_id
+		WHERE r.id = $1
+		ORDER BY m.id, pa.id`, receiptID)
+	if err != nil {
+		return nil, err
+	}
+	warnings, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (AllergyWarning, error) {
+		var warning AllergyWarning
+		var medicineName, substanceName string
+		var reaction *string
+		err := row.Scan(&warning.AllergyID, &warning.MedicineID, &warning.SubstanceID, &medicineName, &substanceName, &reaction)
+		warning.Message = fmt.Sprintf("patient is allergic to %s contained in %s", substanceName, medicineName)
+		if reaction != nil {
+			warning.Message += " (" + *reaction + ")"
+		}
+		return warning, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if warnings == nil {
+		warnings = make([]AllergyWarning, 0)
+	}
+	return warnings, nil
+}
+
+// unacknowledgedAllergies возвращает нарушения для предупреждений, аллергия
+// которых не входит в acknowledged.
+func unacknowledgedAllergies(warnings []AllergyWarning, acknowledged []int) []RuleViolation {
+	seen := make(map[int]bool, len(acknowledged))
+	for _, allergyID := range acknowledged {
+		seen[allergyID] = true
+	}
+	violations := make([]RuleViolation, 0)
+	for _, warning := range warnings {
+		if seen[warning.AllergyID] {
+			continue
+		}
+		medicineID, allergyID := warning.MedicineID, warning.AllergyID
+		violations = append(violations, RuleViolation{
+			Rule:       "allergy",
+			Message:    warning.Message + ", acknowledge to continue",
+			MedicineID: &medicineID,
+			AllergyID:  &allergyID,
+		})
+	}
+	return violations
+}
+
+// recordAllergyAcknowledgements сохраняет, кто из фармацевтов подтвердил
+// предупреждения об аллергии при приёме заказа.
+func recordAllergyAcknowledgements(ctx context.Context, tx pgx.Tx, orderID int, warnings []AllergyWarning, user string) error {
+	for _, warning := range warnings {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO allergy_acknowledgement (order_id, patient_allergy_id, medicine_id, acknowledged_by)
+			VALUES ($1, $2, $3, $4)`, orderID, warning.AllergyID, warning.MedicineID, user)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getPatientAllergiesHandler(w http.ResponseWriter, r *http.Request) {
+	patientID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid patient ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(context.Background(), patientAllergySelect+`
+		WHERE pa.patient_id = $1
+		ORDER BY pa.id`, patientID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	allergies, err := pgx.CollectRows(rows, scanPatientAllergy)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching row: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(allergies)
+}
+
+func createPatientAllergyHandler(w http.ResponseWriter, r *http.Request) {
+	patientID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid patient ID", http.StatusBadRequest)
+		return
+	}
+
+	var allergy PatientAllergy
+	if err := json.NewDecoder(r.Body).Decode(&allergy); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	var allergyID int
+	err = db.QueryRow(ctx, `
+		INSERT INTO patient_allergy (patient_id, substance_id, reaction)
+		VALUES ($1, $2, $3) RETURNING id`,
+		patientID, allergy.SubstanceID, allergy.Reaction,
+	).Scan(&allergyID)
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.As(err, &pgErr) && pgErr.Code == "23503":
+		http.Error(w, "Unknown patient or substance", http.StatusBadRequest)
+		return
+	case errors.As(err, &pgErr) && pgErr.Code == "23505":
+		http.Error(w, "Allergy to this substance is already recorded", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(ctx, patientAllergySelect+` WHERE pa.id = $1`, allergyID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	allergy, err = pgx.CollectOneRow(rows, scanPatientAllergy)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching row: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(allergy)
+}
+
+// deletePatientAllergyHandler удаляет аллергию пациента. Аллергию, которую
+// уже подтверждали при оформлении заказа, удалить нельзя: подтверждение
+// должно оставаться в истории заказа.
+func deletePatientAllergyHandler(w http.ResponseWriter, r *http.Request) {
+	patientID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid patient ID", http.StatusBadRequest)
+		return
+	}
+	allergyID, err := strconv.Atoi(mux.Vars(r)["allergyID"])
+	if err != nil {
+		http.Error(w, "Invalid allergy ID", http.StatusBadRequest)
+		return
+	}
+
+	tag, err := db.Exec(context.Background(),
+		`DELETE FROM patient_allergy WHERE id = $1 AND patient_id = $2`, allergyID, patientID)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		http.Error(w, "Allergy has been acknowledged for an order and cannot be deleted", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Allergy not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+const patientAllergySelect = `
+	SELECT pa.id, pa.patient_id, pa.substance_id, s.name, pa.reaction, pa.noted_at
+	FROM patient_allergy pa
+	JOIN substance s ON s.id = pa.substance_id`
+
+func scanPatientAllergy(row pgx.CollectableRow) (PatientAllergy, error) {
+	var allergy PatientAllergy
+	var notedAt time.Time
+	err := row.Scan(&allergy.ID, &allergy.PatientID, &allergy.SubstanceID, &allergy.SubstanceName,
+		&allergy.Reaction, &notedAt)
+	allergy.NotedAt = notedAt.Format("2006-01-02 15:04:05")
+	return allergy, err
+}
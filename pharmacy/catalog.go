@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type ParamType string
+
+const (
+	ParamInt              ParamType = "int"
+	ParamText             ParamType = "text"
+	ParamTextList         ParamType = "text_list"
+	ParamDate             ParamType = "date"
+	ParamMedicineType     ParamType = "medicine_type"
+	ParamMedicineTypeList ParamType = "medicine_type_list"
+)
+
+// medicineTypes повторяет значения перечисления medicine_type из create_database.sql
+var medicineTypes = []string{"pill", "ointment", "tincture", "mixture", "solution", "powder"}
+
+type QueryParam struct {
+	Name  string    `json:"name"`
+	Label string    `json:"label"`
+	Type  ParamType `json:"type"`
+}
+
+// CatalogQuery - один SQL-файл отчёта. Params перечисляет имена параметров
+// отчёта в порядке подстановки: первый как $1, второй как $2 и т.д.
+// Variant отличает основной запрос ("") от вариантов count, type и type_count.
+type CatalogQuery struct {
+	Name    string   `json:"name"`
+	File    string   `json:"file"`
+	Variant string   `json:"variant,omitempty"`
+	Params  []string `json:"params,omitempty"`
+}
+
+type Report struct {
+	ID      string         `json:"id"`
+	Title   string         `json:"title"`
+	Params  []QueryParam   `json:"params"`
+	Queries []CatalogQuery `json:"queries"`
+}
+
+type QueryCatalog struct {
+	Reports []Report `json:"reports"`
+
+	dir   string
+	index map[string]catalogEntry
+}
+
+type catalogEntry struct {
+	file   string
+	params []QueryParam
+}
+
+var catalog *QueryCatalog
+
+// loadCatalog читает манифест отчётов, лежащий рядом с файлами queries/*.sql,
+// и проверяет, что все файлы существуют, а параметры объявлены в отчёте.
+func loadCatalog(filePath string) (*QueryCatalog, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &QueryCatalog{dir: filepath.Dir(filePath), index: make(map[string]catalogEntry)}
+	if err := json.Unmarshal(content, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+
+	for _, report := range c.Reports {
+		declared := make(map[string]QueryParam, len(report.Params))
+		for _, param := range report.Params {
+			if !param.Type.valid() {
+				return nil, fmt.Errorf("report %s: parameter %q has unsupported type %q", report.ID, param.Name, param.Type)
+			}
+			declared[param.Name] = param
+		}
+		for _, query := range report.Queries {
+			if _, exists := c.index[query.Name]; exists {
+				return nil, fmt.Errorf("report %s: duplicate query name %q", report.ID, query.Name)
+			}
+			if _, err := os.Stat(filepath.Join(c.dir, query.File)); err != nil {
+				return nil, fmt.Errorf("report %s: %v", report.ID, err)
+			}
+			entry := catalogEntry{file: query.File}
+			for _, name := range query.Params {
+				param, ok := declared[name]
+				if !ok {
+					return nil, fmt.Errorf("report %s: query %q uses undeclared parameter %q", report.ID, query.Name, name)
+				}
+				entry.params = append(entry.params, param)
+			}
+			c.index[query.Name] = entry
+		}
+	}
+	return c, nil
+}
+
+func (c *QueryCatalog) Titles() []string {
+	titles := make([]string, len(c.Reports))
+	for i, report := range c.Reports {
+		titles[i] = report.Title
+	}
+	return titles
+}
+
+// Run выполняет запрос каталога по имени, связывая именованные параметры.
+func (c *QueryCatalog) Run(name string, values map[string]interface{}) (*QueryResult, error) {
+	entry, ok := c.index[name]
+	if !ok {
+		return nil, errUnknownQuery
+	}
+
+	args, err := bindParams(entry.params, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return runQueryFile(filepath.Join(c.dir, entry.file), args)
+}
+
+// urlParamValues переводит параметры из строки запроса в тот же вид, что и в
+// JSON: списки собираются из повторяющихся ключей или значений через запятую.
+// Пустые значения считаются отсутствующими.
+func (c *QueryCatalog) urlParamValues(name string, values url.Values) map[string]interface{} {
+	params := make(map[string]interface{})
+	listParams := make(map[string]bool)
+	for _, param := range c.index[name].params {
+		if param.Type == ParamTextList || param.Type == ParamMedicineTypeList {
+			listParams[param.Name] = true
+		}
+	}
+
+	for key, raw := range values {
+		if !listParams[key] {
+			if value := strings.TrimSpace(raw[0]); value != "" {
+				params[key] = value
+			}
+			continue
+		}
+		var list []interface{}
+		for _, item := range raw {
+			for _, part := range strings.Split(item, ",") {
+				if part = strings.TrimSpace(part); part != "" {
+					list = append(list, part)
+				}
+			}
+		}
+		if len(list) > 0 {
+			params[key] = list
+		}
+	}
+	return params
+}
+
+func catalogHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(catalog)
+}
+
+func queryNamesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(catalog.Titles()); err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func executeQuery(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["query"]
+
+	result, err := catalog.Run(name, catalog.urlParamValues(name, r.URL.Query()))
+	writeQueryResult(w, name, result, err)
+}
+
+func queryHandler(w http.ResponseWriter, r *http.Request) {
+	var req QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	result, err := catalog.Run(req.Query, req.Params)
+	writeQueryResult(w, req.Query, result, err)
+}
+
+func writeQueryResult(w http.ResponseWriter, name string, result *QueryResult, err error) {
+	var paramErr *paramError
+	switch {
+	case errors.Is(err, errUnknownQuery):
+		http.Error(w, fmt.Sprintf("Unknown query %q", name), http.StatusNotFound)
+		return
+	case errors.As(err, &paramErr):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+var errUnknownQuery = errors.New("unknown query")
+
+// paramError - ошибка клиента в параметрах запроса (HTTP 400).
+type paramError struct {
+	msg string
+}
+
+func (e *paramError) Error() string {
+	return e.msg
+}
+
+func paramErrorf(format string, args ...interface{}) error {
+	return &paramError{msg: fmt.Sprintf(format, args...)}
+}
+
+func (t ParamType) valid() bool {
+	switch t {
+	case ParamInt, ParamText, ParamTextList, ParamDate, ParamMedicineType, ParamMedicineTypeList:
+		return true
+	}
+	return false
+}
+
+// bindParams раскладывает именованные параметры по позициям $1..$n и
+// проверяет их типы. Лишние и недостающие параметры считаются ошибкой.
+func bindParams(params []QueryParam, values map[string]interface{}) ([]interface{}, error) {
+	declared := make(map[string]bool, len(params))
+	for _, param := range params {
+		declared[param.Name] = true
+	}
+	for name := range values {
+		if !declared[name] {
+			return nil, paramErrorf("unknown parameter %q", name)
+		}
+	}
+
+	args := make([]interface{}, 0, len(params))
+	for _, param := range params {
+		value, ok := values[param.Name]
+		if !ok || value == nil {
+			return nil, paramErrorf("missing parameter %q", param.Name)
+		}
+		arg, err := convertParam(param, value)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// convertParam приводит значение из JSON или строки запроса к типу параметра.
+func convertParam(param QueryParam, value interface{}) (interface{}, error) {
+	switch param.Type {
+	case ParamInt:
+		switch number := value.(type) {
+		case float64:
+			if number == float64(int64(number)) {
+				return int64(number), nil
+			}
+		case string:
+			if parsed, err := strconv.ParseInt(number, 10, 64); err == nil {
+				return parsed, nil
+			}
+		}
+		return nil, paramErrorf("parameter %q must be an integer", param.Name)
+	case ParamText:
+		text, ok := value.(string)
+		if !ok {
+			return nil, paramErrorf("parameter %q must be a string", param.Name)
+		}
+		return text, nil
+	case ParamTextList, ParamMedicineTypeList:
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil, paramErrorf("parameter %q must be a list of strings", param.Name)
+		}
+		list := make([]string, 0, len(items))
+		for _, item := range items {
+			text, ok := item.(string)
+			if !ok {
+				return nil, paramErrorf("parameter %q must be a list of strings", param.Name)
+			}
+			if param.Type == ParamMedicineTypeList && !isMedicineType(text) {
+				return nil, paramErrorf("parameter %q must contain only: %s", param.Name, strings.Join(medicineTypes, ", "))
+			}
+			list = append(list, text)
+		}
+		return list, nil
+	case ParamDate:
+		text, _ := value.(string)
+		date, err := time.Parse("2006-01-02", text)
+		if err != nil {
+			return nil, paramErrorf("parameter %q must be a date in YYYY-MM-DD format", param.Name)
+		}
+		return date, nil
+	case ParamMedicineType:
+		text, ok := value.(string)
+		if !ok || !isMedicineType(text) {
+			return nil, paramErrorf("parameter %q must be one of: %s", param.Name, strings.Join(medicineTypes, ", "))
+		}
+		return text, nil
+	}
+	return nil, fmt.Errorf("parameter %q has unsupported type %q", param.Name, param.Type)
+}
+
+func isMedicineType(value string) bool {
+	for _, medicineType := range medicineTypes {
+		if value == medicineType {
+			return true
+		}
+	}
+	return false
+}
+
+func runQueryFile(filePath string, args []interface{}) (*QueryResult, error) {
+	query, err := loadQueryFromFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := rows.FieldDescriptions()
+	result := &QueryResult{
+		Columns: make([]string, len(columns)),
+		Rows:    make([][]interface{}, 0),
+	}
+
+	for i, col := range columns {
+		result.Columns[i] = string(col.Name)
+	}
+
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return nil, err
+		}
+		result.Rows = append(result.Rows, values)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return result, nil
+}
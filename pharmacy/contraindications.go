@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	SeverityWarning  = "warning"
+	SeverityBlocking = "blocking"
+)
+
+// Contraindication - запись справочника противопоказаний: вещество или тип
+// лекарства, которые нельзя (blocking) или следует с осторожностью (warning)
+// назначать при диагнозе diagnosis и (или) вне возраста min_age..max_age.
+type Contraindication struct {
+	ID            int     `json:"id"`
+	SubstanceID   *int    `json:"substance_id,omitempty"`
+	SubstanceName *string `json:"substance_name,omitempty"`
+	MedicineType  *string `json:"medicine_type,omitempty"`
+	Diagnosis     *string `json:"diagnosis,omitempty"`
+	MinAge        *int    `json:"min_age,omitempty"`
+	MaxAge        *int    `json:"max_age,omitempty"`
+	Severity      string  `json:"severity"`
+	Note          *string `json:"note,omitempty"`
+}
+
+// ContraindicationWarning - сработавшее для рецепта противопоказание
+type ContraindicationWarning struct {
+	ContraindicationID int    `json:"contraindication_id"`
+	MedicineID         int    `json:"medicine_id"`
+	Severity           string `json:"severity"`
+	Message            string `json:"message"`
+}
+
+// checkContraindications сверяет лекарства рецепта и их состав с диагнозом и
+// возрастом пациента. Неизвестные диагноз или возраст пациента соответствующие
+// условия не выполняют.
+func checkContraindications(ctx context.Context, q querier, receiptID int) ([]ContraindicationWarning, error) {
+	rows, err := q.Query(ctx, `
+		SELECT c.id, m.id, m.name, s.name, m.type::text, c.severity::text,
+		       c.diagnosis, c.min_age, c.max_age, p.age, c.note
+		FROM receipt r
+		JOIN patient p ON p.id = r.patient_id
+		JOIN medicine_list ml ON ml.receipt_id = r.id
+		JOIN medicine m ON m.id = ml.medicine_id
+		JOIN contraindication c
+		  ON c.medicine_type = m.type
+		  OR c.substance_id IN (SELECT mc.substance_id FROM medicine_composition mc
+		                        JOIN local_medicine lm ON lm.id = mc.medicine_id
+		                        WHERE lm.medicine_id = m.id)
+		LEFT JOIN substance s ON s.id = c.substance_id
+		WHERE r.id = $1
+		  AND (c.diagnosis IS NULL OR lower(trim(c.diagnosis)) = lower(trim(p.diagnosis)))
+		  AND ((c.min_age IS NULL AND c.max_age IS NULL) OR p.age < c.min_age OR p.age > c.max_age)
+		ORDER BY ml.id, c.id`, receiptID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ContraindicationWarning, error) {
+		var warning ContraindicationWarning
+		var medicineName, medicineType string
+		var substanceName, diagnosis, note *string
+		var minAge, maxAge, age *int
+		err := row.Scan(&warning.ContraindicationID, &warning.MedicineID, &medicineName, &substanceName,
+			&medicineType, &warning.Severity, &diagnosis, &minAge, &maxAge, &age, &note)
+		if err != nil {
+			return warning, err
+		}
+
+		subject := fmt.Sprintf("%s (%s)", medicineName, medicineType)
+		if substanceName != nil {
+			subject = fmt.Sprintf("%s (contains %s)", medicineName, *substanceName)
+		}
+		conditions := make([]string, 0, 2)
+		if diagnosis != nil {
+			conditions = append(conditions, "diagnosis "+*diagnosis)
+		}
+		if age != nil && (minAge != nil || maxAge != nil) {
+			conditions = append(conditions, fmt.Sprintf("age %d", *age))
+		}
+		warning.Message = fmt.Sprintf("%s is contraindicated for %s", subject, strings.Join(conditions, " and "))
+		if note != nil {
+			warning.Message += ": " + *note
+		}
+		return warning, nil
+	})
+}
+
+// blockingContraindications отделяет запрещающие противопоказания в виде
+// нарушений правил от предупреждений, которые не мешают приёму рецепта.
+func blockingContraindications(found []ContraindicationWarning) (violations []RuleViolation, warnings []ContraindicationWarning) {
+	warnings = make([]ContraindicationWarning, 0)
+	for _, warning := range found {
+		if warning.Severity != SeverityBlocking {
+			warnings = append(warnings, warning)
+			continue
+		}
+		medicineID := warning.MedicineID
+		violations = append(violations, RuleViolation{Rule: "contraindication", Message: warning.Message, MedicineID: &medicineID})
+	}
+	return violations, warnings
+}
+
+func getContraindicationsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(context.Background(), `
+		SELECT c.id, c.substance_id, s.name, c.medicine_type::text, c.diagnosis, c.min_age, c.max_age,
+		       c.severity::text, c.note
+		FROM contraindication c
+		LEFT JOIN substance s ON s.id = c.substance_id
+		ORDER BY c.id`)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	contraindications, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Contraindication, error) {
+		var c Contraindication
+		err := row.Scan(&c.ID, &c.SubstanceID, &c.SubstanceName, &c.MedicineType, &c.Diagnosis,
+			&c.MinAge, &c.MaxAge, &c.Severity, &c.Note)
+		return c, err
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching row: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(contraindications)
+}
+
+func createContraindicationHandler(w http.ResponseWriter, r *http.Request) {
+	var c Contraindication
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if c.Severity == "" {
+		c.Severity = SeverityWarning
+	}
+	switch {
+	case (c.SubstanceID == nil) == (c.MedicineType == nil):
+		http.Error(w, "Either substance_id or medicine_type is required", http.StatusBadRequest)
+		return
+	case c.MedicineType != nil && !isMedicineType(*c.MedicineType):
+		http.Error(w, fmt.Sprintf("Invalid medicine_type, expected one of %v", medicineTypes), http.StatusBadRequest)
+		return
+	case c.Diagnosis == nil && c.MinAge == nil && c.MaxAge == nil:
+		http.Error(w, "At least one of diagnosis, min_age or max_age is required", http.StatusBadRequest)
+		return
+	case c.MinAge != nil && c.MaxAge != nil && *c.MinAge > *c.MaxAge:
+		http.Error(w, "min_age must not exceed max_age", http.StatusBadRequest)
+		return
+	case c.Severity != SeverityWarning && c.Severity != SeverityBlocking:
+		http.Error(w, "Invalid severity, expected warning or blocking", http.StatusBadRequest)
+		return
+	}
+
+	err := db.QueryRow(context.Background(), `
+		INSERT INTO contraindication (substance_id, medicine_type, diagnosis, min_age, max_age, severity, note)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		c.SubstanceID, c.MedicineType, c.Diagnosis, c.MinAge, c.MaxAge, c.Severity, c.Note,
+	).Scan(&c.ID)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		http.Error(w, "Unknown substance", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+func deleteContraindicationHandler(w http.ResponseWriter, r *http.Request) {
+	contraindicationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid contraindication ID", http.StatusBadRequest)
+		return
+	}
+
+	tag, err := db.Exec(context.Background(), `DELETE FROM contraindication WHERE id = $1`, contraindicationID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Contraindication not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// Invoice - счёт по заказу. Пока заказ не готов, счёт рассчитывается по
+// текущим ценам (final = false); при переходе в ready суммы сохраняются в
+// invoice и дальше не меняются.
+type Invoice struct {
+	OrderID         int           `json:"order_id"`
+	Final           bool          `json:"final"`
+	IssuedAt        *string       `json:"issued_at"`
+	Lines           []InvoiceLine `json:"lines"`
+	GoodsTotal      float64       `json:"goods_total"`
+	ProductionTotal float64       `json:"production_total"`
+	Total           float64       `json:"total"`
+}
+
+// InvoiceLine - строка рецепта с ценой из представления receipt_line_price:
+// для готового лекарства UnitPrice - цена medicine.price, для аптечного
+// изготовления - стоимость веществ по medicine_composition; ProductionFee
+// берётся из технологии один раз на строку.
+type InvoiceLine struct {
+	MedicineID    int     `json:"medicine_id"`
+	Name          string  `json:"name"`
+	Quantity      float64 `json:"quantity"`
+	UnitPrice     float64 `json:"unit_price"`
+	ProductionFee float64 `json:"production_fee"`
+	Amount        float64 `json:"amount"`
+}
+
+func roundMoney(value float64) float64 {
+	return math.Round(value*100) / 100
+}
+
+// computeInvoice рассчитывает счёт заказа по текущим ценам.
+// pgx.ErrNoRows - заказ не найден.
+func computeInvoice(ctx context.Context, q querier, orderID int) (Invoice, error) {
+	invoice := Invoice{OrderID: orderID}
+	var receiptID int
+	if err := q.QueryRow(ctx, `SELECT receipt_id FROM orders WHERE id = $1`, orderID).Scan(&receiptID); err != nil {
+		return invoice, err
+	}
+
+	// Цены строк считает представление receipt_line_price, общее со
+	// отчётом о неоплаченных заказах
+	rows, err := q.Query(ctx, `
+		SELECT rlp.medicine_id, m.name, rlp.quantity, rlp.unit_price, rlp.production_fee, rlp.amount
+		FROM receipt_line_price rlp
+		JOIN medicine m ON m.id = rlp.medicine_id
+		WHERE rlp.receipt_id = $1
+		ORDER BY rlp.medicine_list_id`, receiptID)
+	if err != nil {
+		return invoice, err
+	}
+	invoice.Lines, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (InvoiceLine, error) {
+		var line InvoiceLine
+		err := row.Scan(&line.MedicineID, &line.Name, &line.Quantity, &line.UnitPrice, &line.ProductionFee, &line.Amount)
+		return line, err
+	})
+	if err != nil {
+		return invoice, err
+	}
+
+	for _, line := range invoice.Lines {
+		invoice.GoodsTotal += line.Amount - line.ProductionFee
+		invoice.ProductionTotal += line.ProductionFee
+	}
+	invoice.GoodsTotal = roundMoney(invoice.GoodsTotal)
+	invoice.ProductionTotal = roundMoney(invoice.ProductionTotal)
+	invoice.Total = roundMoney(invoice.GoodsTotal + invoice.ProductionTotal)
+	return invoice, nil
+}
+
+// storeInvoice фиксирует счёт заказа. Вызывается в транзакции перехода
+// заказа в ready; повторный вызов сохранённый счёт не меняет. Если итог
+// оказался меньше внесённых предоплат, переплата возвращается от имени user.
+func storeInvoice(ctx context.Context, tx pgx.Tx, orderID int, user string) error {
+	invoice, err := computeInvoice(ctx, tx, orderID)
+	if err != nil {
+		return err
+	}
+
+	var invoiceID int
+	err = tx.QueryRow(ctx, `
+		INSERT INTO invoice (order_id, goods_total, production_total, total)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (order_id) DO NOTHING
+		RETURNING id`, orderID, invoice.GoodsTotal, invoice.ProductionTotal, invoice.Total,
+	).Scan(&invoiceID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, line := range invoice.Lines {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO invoice_line (invoice_id, medicine_id, quantity, unit_price, production_fee, amount)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			invoiceID, line.MedicineID, line.Quantity, line.UnitPrice, line.ProductionFee, line.Amount)
+		if err != nil {
+			return err
+		}
+	}
+	return refundOverpayment(ctx, tx, orderID, user)
+}
+
+// loadInvoice возвращает сохранённый счёт, а если его ещё нет - расчёт по
+// текущим ценам.
+func loadInvoice(ctx context.Context, q querier, orderID int) (Invoice, error) {
+	invoice := Invoice{OrderID: orderID, Final: true}
+	var invoiceID int
+	var issuedAt time.Time
+	err := q.QueryRow(ctx, `
+		SELECT id, goods_total, production_total, total, issued_at
+		FROM invoice
+		WHERE order_id = $1`, orderID,
+	).Scan(&invoiceID, &invoice.GoodsTotal, &invoice.ProductionTotal, &invoice.Total, &issuedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return computeInvoice(ctx, q, orderID)
+	}
+	if err != nil {
+		return invoice, err
+	}
+	invoice.IssuedAt = formatOptionalTime(&issuedAt)
+
+	rows, err := q.Query(ctx, `
+		SELECT il.medicine_id, m.name, il.quantity, il.unit_price, il.production_fee, il.amount
+		FROM invoice_line il
+		JOIN medicine m ON m.id = il.medicine_id
+		WHERE il.invoice_id = $1
+		ORDER BY il.id`, invoiceID)
+	if err != nil {
+		return invoice, err
+	}
+	invoice.Lines, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (InvoiceLine, error) {
+		var line InvoiceLine
+		err := row.Scan(&line.MedicineID, &line.Name, &line.Quantity, &line.UnitPrice, &line.ProductionFee, &line.Amount)
+		return line, err
+	})
+	return invoice, err
+}
+
+func getInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	invoice, err := loadInvoice(context.Background(), db, orderID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoice)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// Label - этикетка лекарства аптечного изготовления для строки рецепта
+type Label struct {
+	LineID      int
+	Medicine    string
+	Quantity    float64
+	Dosage      *string
+	Patient     string
+	PatientAge  *int
+	Doctor      string
+	Composition []LabelComponent
+	ProducedAt  *time.Time // nil, пока лекарство не изготовлено по заказу
+	ExpiresAt   *time.Time
+}
+
+type LabelComponent struct {
+	Substance string
+	Quantity  float64
+}
+
+// labelFormats - форматы этикеток: ZPL для термопринтеров этикеток и текст
+var labelFormats = map[string]struct {
+	contentType string
+	extension   string
+	render      func(labels []Label) string
+}{
+	"zpl":  {"application/zpl; charset=utf-8", "zpl", renderLabelsZPL},
+	"text": {"text/plain; charset=utf-8", "txt", renderLabelsText},
+}
+
+// loadLabels собирает этикетки строк рецепта receiptID, которые изготавливаются
+// в аптеке (lineID = 0 - все такие строки). Дата изготовления берётся из слота
+// производства заказа orderID, затем из даты готовности заказа; без заказа
+// даты изготовления и срока годности нет. Срок годности - shelf_life
+// технологии. Количество веществ в составе приводится на всю строку рецепта.
+func loadLabels(ctx context.Context, q querier, receiptID, lineID int, orderID *int) ([]Label, error) {
+	rows, err := q.Query(ctx, `
+		WITH line AS (
+			SELECT ml.id, m.name, ml.quantity_used, ml.dosage, lm.id AS local_id, pt.shelf_life,
+			       p.surname || ' ' || p.name || COALESCE(' ' || p.middle_name, '') AS patient, p.age,
+			       d.surname || ' ' || d.name || COALESCE(' ' || d.middle_name, '') AS doctor,
+			       COALESCE(
+			           (SELECT MAX(ps.ends_at) FROM production_slot ps
+			            WHERE ps.order_id = $3 AND ps.medicine_id = ml.medicine_id),
+			           (SELECT o.production_date FROM orders o WHERE o.id = $3)) AS produced_at
+			FROM medicine_list ml
+			JOIN receipt r ON r.id = ml.receipt_id
+			JOIN patient p ON p.id = r.patient_id
+			JOIN doctor d ON d.id = r.doctor_id
+			JOIN medicine m ON m.id = ml.medicine_id
+			JOIN local_medicine lm ON lm.medicine_id = m.id
+			JOIN production_techonology pt ON pt.id = lm.production_techology
+			WHERE ml.receipt_id = $1 AND ($2 = 0 OR ml.id = $2)
+		)
+		SELECT id, name, quantity_used, dosage, local_id, patient, age, doctor,
+		       produced_at, produced_at + shelf_life
+		FROM line
+		ORDER BY id`, receiptID, lineID, orderID)
+	if err != nil {
+		return nil, err
+	}
+	localIDs := make(map[int]int)
+	labels, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Label, error) {
+		var label Label
+		var localID int
+		err := row.Scan(&label.LineID, &label.Medicine, &label.Quantity, &label.Dosage, &localID,
+			&label.Patient, &label.PatientAge, &label.Doctor, &label.ProducedAt, &label.ExpiresAt)
+		localIDs[label.LineID] = localID
+		return label, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range labels {
+		rows, err := q.Query(ctx, `
+			SELECT s.name, mc.required_quantity * $2
+			FROM medicine_composition mc
+			JOIN substance s ON s.id = mc.substance_id
+			WHERE mc.medicine_id = $1
+			ORDER BY mc.id`, localIDs[labels[i].LineID], labels[i].Quantity)
+		if err != nil {
+			return nil, err
+		}
+		labels[i].Composition, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (LabelComponent, error) {
+			var component LabelComponent
+			err := row.Scan(&component.Substance, &component.Quantity)
+			return component, err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return labels, nil
+}
+
+// labelLines - содержимое этикетки построчно, общее для всех форматов
+func labelLines(label Label) []string {
+	patient := label.Patient
+	if label.PatientAge != nil {
+		patient = fmt.Sprintf("%s, возраст %d", patient, *label.PatientAge)
+	}
+	lines := []string{
+		fmt.Sprintf("%s, %v", label.Medicine, label.Quantity),
+		"Пациент: " + patient,
+		"Врач: " + label.Doctor,
+		"Состав:",
+	}
+	for _, component := range label.Composition {
+		lines = append(lines, fmt.Sprintf("  %s - %v", component.Substance, component.Quantity))
+	}
+	// Без заказа даты не известны и остаются полями для заполнения от руки
+	producedAt, expiresAt := "__________", "__________"
+	if label.ProducedAt != nil {
+		producedAt = label.ProducedAt.Format("02.01.2006 15:04")
+	}
+	if label.ExpiresAt != nil {
+		expiresAt = label.ExpiresAt.Format("02.01.2006")
+	}
+	lines = append(lines,
+		"Изготовлено: "+producedAt,
+		"Годен до: "+expiresAt,
+	)
+	if label.Dosage != nil && *label.Dosage != "" {
+		lines = append(lines, "Применение: "+*label.Dosage)
+	}
+	return lines
+}
+
+func renderLabelsText(labels []Label) string {
+	var b strings.Builder
+	for i, label := range labels {
+		if i > 0 {
+			b.WriteString("\n" + strings.Repeat("-", 40) + "\n\n")
+		}
+		b.WriteString(strings.Join(labelLines(label), "\n"))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// renderLabelsZPL печатает каждую этикетку отдельным форматом ^XA...^XZ;
+// ^CI28 включает UTF-8, а масштабируемый шрифт TT0003M_ (Unicode) нужен для
+// кириллицы: встроенный шрифт ^A0 содержит только латиницу.
+func renderLabelsZPL(labels []Label) string {
+	var b strings.Builder
+	for _, label := range labels {
+		b.WriteString("^XA\n^CI28\n^PW800\n")
+		y := 30
+		for i, line := range labelLines(label) {
+			height := 28
+			if i == 0 {
+				height = 36
+			}
+			// ^ и ~ - управляющие символы ZPL
+			line = strings.NewReplacer("^", " ", "~", " ").Replace(line)
+			fmt.Fprintf(&b, "^FO30,%d^A@N,%d,%d,E:TT0003M_.TTF^FD%s^FS\n", y, height, height, line)
+			y += height + 10
+		}
+		b.WriteString("^XZ\n")
+	}
+	return b.String()
+}
+
+func writeLabels(w http.ResponseWriter, r *http.Request, labels []Label, name string) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zpl"
+	}
+	renderer, ok := labelFormats[format]
+	if !ok {
+		http.Error(w, "Invalid format, expected zpl or text", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", renderer.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+renderer.extension))
+	fmt.Fprint(w, renderer.render(labels))
+}
+
+// getOrderLabelsHandler печатает этикетки всех лекарств аптечного изготовления
+// заказа (параметр format: zpl по умолчанию или text).
+func getOrderLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	var receiptID int
+	err = db.QueryRow(ctx, `SELECT receipt_id FROM orders WHERE id = $1`, orderID).Scan(&receiptID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	labels, err := loadLabels(ctx, db, receiptID, 0, &orderID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(labels) == 0 {
+		http.Error(w, "Order has no compounded medicines", http.StatusNotFound)
+		return
+	}
+
+	writeLabels(w, r, labels, fmt.Sprintf("order-%d-labels", orderID))
+}
+
+// getReceiptLineLabelHandler печатает этикетку одной строки рецепта. Если по
+// рецепту оформлен заказ, дата изготовления берётся из него.
+func getReceiptLineLabelHandler(w http.ResponseWriter, r *http.Request) {
+	receiptID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid receipt ID", http.StatusBadRequest)
+		return
+	}
+	lineID, err := strconv.Atoi(mux.Vars(r)["lineID"])
+	if err != nil {
+		http.Error(w, "Invalid line ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	var orderID *int
+	err = db.QueryRow(ctx, `
+		SELECT id FROM orders
+		WHERE receipt_id = $1 AND status <> 'cancelled'
+		ORDER BY id DESC
+		LIMIT 1`, receiptID).Scan(&orderID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	labels, err := loadLabels(ctx, db, receiptID, lineID, orderID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(labels) == 0 {
+		http.Error(w, "Line not found or not a compounded medicine", http.StatusNotFound)
+		return
+	}
+
+	writeLabels(w, r, labels, fmt.Sprintf("receipt-%d-line-%d-label", receiptID, lineID))
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -55,9 +58,26 @@ type Doctor struct {
 }
 
 type Receipt struct {
-	ID        int `json:"id"`
-	DoctorID  int `json:"doctor_id"`
-	PatientID int `json:"patient_id"`
+	ID        int    `json:"id"`
+	DoctorID  int    `json:"doctor_id"`
+	PatientID int    `json:"patient_id"`
+	IssuedAt  string `json:"issued_at"`
+
+	Doctor    *Doctor        `json:"doctor,omitempty"`
+	Patient   *Patient       `json:"patient,omitempty"`
+	Medicines []MedicineLine `json:"medicines,omitempty"`
+
+	Warnings  []ContraindicationWarning `json:"warnings,omitempty"`
+	Allergies []AllergyWarning          `json:"allergies,omitempty"`
+}
+
+type MedicineLine struct {
+	ID           int     `json:"id"`
+	MedicineID   int     `json:"medicine_id"`
+	Name         string  `json:"name"`
+	Type         string  `json:"type"`
+	QuantityUsed float64 `json:"quantity_used"`
+	Dosage       *string `json:"dosage"`
 }
 
 type Order struct {
@@ -67,6 +87,21 @@ type Order struct {
 	OrderDate      string `json:"order_date"`
 	ProductionDate string `json:"production_date"`
 	Status         string `json:"status"`
+
+	ApprovedBy *string `json:"approved_by,omitempty"`
+	PickedUpAt *string `json:"picked_up_at,omitempty"`
+	PickedUpBy *string `json:"picked_up_by,omitempty"`
+	// Почему изготовленный заказ не удалось перевести в ready
+	ProductionError *string `json:"production_error,omitempty"`
+
+	Customer  *Customer      `json:"customer,omitempty"`
+	Doctor    *Doctor        `json:"doctor,omitempty"`
+	Patient   *Patient       `json:"patient,omitempty"`
+	Medicines []MedicineLine `json:"medicines,omitempty"`
+
+	// Аллергии пациента, которые фармацевт подтвердил при приёме заказа
+	AcknowledgedAllergies []int                     `json:"acknowledged_allergies,omitempty"`
+	Warnings              []ContraindicationWarning `json:"warnings,omitempty"`
 }
 
 func main() {
@@ -103,16 +138,79 @@ func main() {
 		log.Fatalf("Unable to ping database: %v\n", err)
 	}
 
+	catalog, err = loadCatalog("queries/catalog.json")
+	if err != nil {
+		log.Fatalf("Unable to load query catalog: %v\n", err)
+	}
+
+	prescriptionRules, err = loadPrescriptionRules(getEnv("PRESCRIPTION_RULES", "prescription_rules.json"))
+	if err != nil {
+		log.Fatalf("Unable to load prescription rules: %v\n", err)
+	}
+
 	r := mux.NewRouter()
 
 	r.HandleFunc("/query_names", queryNamesHandler).Methods("GET")
+	r.HandleFunc("/catalog", catalogHandler).Methods("GET")
 
 	r.HandleFunc("/queries/{query}", executeQuery).Methods("GET")
 	r.HandleFunc("/query", queryHandler).Methods("POST")
 	r.HandleFunc("/orders", getOrdersHandler).Methods("GET")
-	r.HandleFunc("/orders", createOrderHandler).Methods("POST")
+	r.HandleFunc("/orders", createOrder).Methods("POST")
+	r.HandleFunc("/orders/{id}", getOrderHandler).Methods("GET")
 	r.HandleFunc("/orders/{id}", updateOrderHandler).Methods("PUT")
 	r.HandleFunc("/orders/{id}", deleteOrderHandler).Methods("DELETE")
+	r.HandleFunc("/orders/{id}/status", changeOrderStatusHandler).Methods("POST")
+	r.HandleFunc("/orders/{id}/history", getOrderHistoryHandler).Methods("GET")
+	r.HandleFunc("/orders/{id}/pickup", pickupOrderHandler).Methods("POST")
+	r.HandleFunc("/orders/{id}/invoice", getInvoiceHandler).Methods("GET")
+	r.HandleFunc("/orders/{id}/payments", getOrderPaymentsHandler).Methods("GET")
+	r.HandleFunc("/orders/{id}/payments", createPaymentHandler).Methods("POST")
+	r.HandleFunc("/orders/{id}/labels", getOrderLabelsHandler).Methods("GET")
+
+	r.HandleFunc("/customers", getCustomersHandler).Methods("GET")
+	r.HandleFunc("/customers", createCustomer).Methods("POST")
+	r.HandleFunc("/customers/{id}", getCustomerHandler).Methods("GET")
+	r.HandleFunc("/customers/{id}", updateCustomerHandler).Methods("PUT")
+	r.HandleFunc("/customers/{id}", deleteCustomerHandler).Methods("DELETE")
+
+	r.HandleFunc("/production/schedule", getProductionScheduleHandler).Methods("GET")
+	r.HandleFunc("/alerts/stream", streamAlertsHandler).Methods("GET")
+	r.HandleFunc("/notifications", getNotificationsHandler).Methods("GET")
+	r.HandleFunc("/notifications/{id}/retry", retryNotificationHandler).Methods("POST")
+
+	r.HandleFunc("/contraindications", getContraindicationsHandler).Methods("GET")
+	r.HandleFunc("/contraindications", createContraindicationHandler).Methods("POST")
+	r.HandleFunc("/contraindications/{id}", deleteContraindicationHandler).Methods("DELETE")
+
+	r.HandleFunc("/suppliers", getSuppliersHandler).Methods("GET")
+	r.HandleFunc("/suppliers", createSupplierHandler).Methods("POST")
+	r.HandleFunc("/purchase_orders", getPurchaseOrdersHandler).Methods("GET")
+	r.HandleFunc("/purchase_orders", createPurchaseOrderHandler).Methods("POST")
+	r.HandleFunc("/purchase_orders/shortages", getShortagesHandler).Methods("GET")
+	r.HandleFunc("/purchase_orders/{id}", getPurchaseOrderHandler).Methods("GET")
+	r.HandleFunc("/purchase_orders/{id}", deletePurchaseOrderHandler).Methods("DELETE")
+	r.HandleFunc("/purchase_orders/{id}/send", sendPurchaseOrderHandler).Methods("POST")
+	r.HandleFunc("/goods_receipts", createGoodsReceiptHandler).Methods("POST")
+	r.HandleFunc("/goods_receipts/{id}", getGoodsReceiptHandler).Methods("GET")
+	r.HandleFunc("/stock_movements", getStockMovementsHandler).Methods("GET")
+	r.HandleFunc("/write_offs", getWriteOffsHandler).Methods("GET")
+	r.HandleFunc("/write_offs", createWriteOffHandler).Methods("POST")
+	r.HandleFunc("/write_offs/expired", writeOffExpiredHandler).Methods("POST")
+
+	r.HandleFunc("/receipts", createReceipt).Methods("POST")
+	r.HandleFunc("/receipts/{id}", getReceiptHandler).Methods("GET")
+	r.HandleFunc("/receipts/{id}/validation", validateReceiptHandler).Methods("GET")
+	r.HandleFunc("/receipts/{id}/patient", getReceiptPatientHandler).Methods("GET")
+	r.HandleFunc("/receipts/{id}/doctor", getReceiptDoctorHandler).Methods("GET")
+	r.HandleFunc("/receipts/{id}/medicines", getReceiptMedicinesHandler).Methods("GET")
+	r.HandleFunc("/receipts/{id}/medicines", updateReceiptMedicinesHandler).Methods("PUT")
+	r.HandleFunc("/receipts/{id}/medicines/{lineID}/label", getReceiptLineLabelHandler).Methods("GET")
+	r.HandleFunc("/patients/{id}", updatePatientHandler).Methods("PUT")
+	r.HandleFunc("/patients/{id}/allergies", getPatientAllergiesHandler).Methods("GET")
+	r.HandleFunc("/patients/{id}/allergies", createPatientAllergyHandler).Methods("POST")
+	r.HandleFunc("/patients/{id}/allergies/{allergyID}", deletePatientAllergyHandler).Methods("DELETE")
+	r.HandleFunc("/doctors/{id}", updateDoctorHandler).Methods("PUT")
 
 	r.HandleFunc("/create_customer", createCustomer).Methods("POST")
 	r.HandleFunc("/create_patient", createPatient).Methods("POST")
@@ -120,6 +218,33 @@ func main() {
 	r.HandleFunc("/create_receipt", createReceipt).Methods("POST")
 	r.HandleFunc("/create_order", createOrder).Methods("POST")
 
+	if value := getEnv("PRODUCTION_DAY_START", ""); value != "" {
+		dayStart, err := time.Parse("15:04", value)
+		if err != nil {
+			log.Fatalf("Invalid PRODUCTION_DAY_START %q, expected HH:MM\n", value)
+		}
+		productionDayStart = time.Duration(dayStart.Hour())*time.Hour + time.Duration(dayStart.Minute())*time.Minute
+	}
+
+	workerInterval, err := time.ParseDuration(getEnv("PRODUCTION_WORKER_INTERVAL", "1m"))
+	if err != nil || workerInterval <= 0 {
+		log.Fatalf("Invalid PRODUCTION_WORKER_INTERVAL, expected duration such as 30s or 5m\n")
+	}
+	go runProductionWorker(context.Background(), workerInterval)
+	go listenStockAlerts(context.Background())
+
+	if value := getEnv("NOTIFICATION_MAX_ATTEMPTS", ""); value != "" {
+		notificationMaxAttempts, err = strconv.Atoi(value)
+		if err != nil || notificationMaxAttempts <= 0 {
+			log.Fatalf("Invalid NOTIFICATION_MAX_ATTEMPTS %q\n", value)
+		}
+	}
+	sender, err := newSender()
+	if err != nil {
+		log.Fatalf("Unable to create notification sender: %v\n", err)
+	}
+	go runNotificationDispatcher(context.Background(), sender, 30*time.Second)
+
 	port := getEnv("SERVER_PORT", "8000")
 
 	fmt.Printf("Server running on port %s\n", port)
@@ -133,361 +258,835 @@ func createOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var medicineID int
-	var medicineType string
-	var productionDate time.Time
-	var status string
-
-	rows, err := db.Query(context.Background(), `
-		SELECT m.id, m.type 
-		FROM medicine_list ml
-		JOIN medicine m ON ml.medicine_id = m.id
-		WHERE ml.receipt_id = $1`, order.ReceiptID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Заказ оформляется сегодняшним днём по часам сервера; дата клиента
+	// допускается только как подтверждение
+	orderDate := truncateToDay(wallClock(time.Now()))
+	if order.OrderDate != "" && order.OrderDate != orderDate.Format("2006-01-02") {
+		http.Error(w, fmt.Sprintf("order_date must be today (%s)", orderDate.Format("2006-01-02")), http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
+	order.OrderDate = orderDate.Format("2006-01-02")
 
-	orderDate, err := time.Parse("2006-01-02", order.OrderDate)
+	user, err := requestUser(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	allMedicinesAvailable := true
-	for rows.Next() {
-		if err := rows.Scan(&medicineID, &medicineType); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		var totalAmount int
-		err := db.QueryRow(context.Background(), `SELECT total_amount FROM medicine_warehouse WHERE medicine_id = $1`, medicineID).Scan(&totalAmount)
-		if err != nil || totalAmount <= 0 {
-			allMedicinesAvailable = false
-			if medicineType == "local_medicine" {
-				var productionTime string
-				err = db.QueryRow(context.Background(), `SELECT pt.time_to_product FROM local_medicine lm JOIN production_techonology pt ON lm.production_techology = pt.id WHERE lm.medicine_id = $1`, medicineID).Scan(&productionTime)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				duration, err := time.ParseDuration(productionTime)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				productionDate = orderDate.Add(duration)
-			} else {
-				productionDate = orderDate.AddDate(0, 0, 7) // неделя после начала заказа
-			}
-		}
-	}
-
-	if allMedicinesAvailable {
-		status = "done"
-		productionDate = orderDate
-	} else {
-		status = "in_production"
-	}
-
-	err = db.QueryRow(context.Background(),
-		`INSERT INTO orders (customer_id, receipt_id, order_date, production_date, status)
-		 VALUES ($1, $2, $3, $4, $5) RETURNING id`,
-		order.CustomerID, order.ReceiptID, order.OrderDate, productionDate, status,
-	).Scan(&order.ID)
-
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback(ctx)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(order)
-}
-
-func createReceipt(w http.ResponseWriter, r *http.Request) {
-	var receipt Receipt
-	if err := json.NewDecoder(r.Body).Decode(&receipt); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	approvedBy := ""
+	if order.ApprovedBy != nil {
+		approvedBy = *order.ApprovedBy
+	}
+	violations, err := prescriptionRules.validate(ctx, tx, order.ReceiptID, approvedBy, user)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Receipt not found", http.StatusBadRequest)
 		return
 	}
-
-	err := db.QueryRow(context.Background(),
-		`INSERT INTO receipt (doctor_id, patient_id)
-		 VALUES ($1, $2) RETURNING id`,
-		receipt.DoctorID, receipt.PatientID,
-	).Scan(&receipt.ID)
-
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(receipt)
-}
-
-func createDoctor(w http.ResponseWriter, r *http.Request) {
-	var doctor Doctor
-	if err := json.NewDecoder(r.Body).Decode(&doctor); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	found, err := checkContraindications(ctx, tx, order.ReceiptID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	err := db.QueryRow(context.Background(),
-		`INSERT INTO doctor (surname, name, middle_name)
-		 VALUES ($1, $2, $3) RETURNING id`,
-		doctor.Surname, doctor.Name, doctor.MiddleName,
-	).Scan(&doctor.ID)
-
+	blocking, warnings := blockingContraindications(found)
+	violations = append(violations, blocking...)
+	allergies, err := checkAllergies(ctx, tx, order.ReceiptID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(doctor)
-}
-
-func createPatient(w http.ResponseWriter, r *http.Request) {
-	var patient Patient
-	if err := json.NewDecoder(r.Body).Decode(&patient); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	violations = append(violations, unacknowledgedAllergies(allergies, order.AcknowledgedAllergies)...)
+	if len(violations) > 0 {
+		writeRuleViolations(w, violations)
 		return
 	}
 
-	err := db.QueryRow(context.Background(),
-		`INSERT INTO patient (surname, name, middle_name, age, diagnosis)
-		 VALUES ($1, $2, $3, $4, $5) RETURNING id`,
-		patient.Surname, patient.Name, patient.MiddleName, patient.Age, patient.Diagnosis,
-	).Scan(&patient.ID)
-
+	err = placeOrder(ctx, tx, &order, orderDate, user)
+	var scheduleErr *scheduleError
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Receipt not found", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errReceiptHasOrder) {
+		http.Error(w, "Receipt already has an active order", http.StatusConflict)
+		return
+	}
+	if errors.As(err, &scheduleErr) {
+		http.Error(w, fmt.Sprintf("Cannot schedule production: %v", err), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(patient)
-}
-
-func createCustomer(w http.ResponseWriter, r *http.Request) {
-	var customer Customer
-	if err := json.NewDecoder(r.Body).Decode(&customer); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := recordAllergyAcknowledgements(ctx, tx, order.ID, allergies, user); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	err := db.QueryRow(context.Background(),
-		`INSERT INTO customer (surname, name, middle_name, phone_number, address)
-		 VALUES ($1, $2, $3, $4, $5) RETURNING id`,
-		customer.Surname, customer.Name, customer.MiddleName, customer.PhoneNumber, customer.Address,
-	).Scan(&customer.ID)
-
-	if err != nil {
+	if err := tx.Commit(ctx); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	order.Warnings = warnings
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(customer)
+	json.NewEncoder(w).Encode(order)
+}
+
+type orderLine struct {
+	medicineID    int
+	quantity      float64
+	isLocal       bool
+	timeToProduct *int64 // секунды
+}
+
+type stockItem struct {
+	medicineID  int
+	substanceID int
+	quantity    float64
+}
+
+// orderPlan - как будут выполнены строки рецепта: что резервируется на
+// складе, что ставится в расписание изготовления и когда будут готовы строки,
+// ожидающие поставки.
+type orderPlan struct {
+	medicineReservations  []stockItem
+	substanceReservations []stockItem
+	jobs                  []productionJob
+	waiting               bool // есть строки, ожидающие поставки
+	productionDate        time.Time
 }
 
-func queryNamesHandler(w http.ResponseWriter, r *http.Request) {
-	names, err := loadQueryNamesFromFile("queries/query_names.txt")
+// errReceiptHasOrder - по рецепту уже есть заказ, который не отменён и не
+// просрочен (HTTP 409).
+var errReceiptHasOrder = errors.New("receipt already has an active order")
+
+// placeOrder оформляет заказ внутри транзакции tx. Строки склада по всем
+// медикаментам рецепта и веществам для их изготовления блокируются
+// (SELECT ... FOR UPDATE) в порядке id, поэтому параллельные заказы видят
+// согласованные остатки и не могут зарезервировать один и тот же товар.
+//
+// Доступный остаток - непросроченные партии за вычетом reserved_amount. Готовый
+// медикамент резервируется на складе и списывается из партий при выдаче
+// заказа, для аптечного изготовления резервируются вещества из
+// medicine_composition. Строки, ожидающие поставки, планируются повторно
+// при приёмке (replanWaitingOrders).
+func placeOrder(ctx context.Context, tx pgx.Tx, order *Order, orderDate time.Time, user string) error {
+	// Блокировка рецепта упорядочивает одновременные запросы, а проверка под
+	// ней не даёт оформить по рецепту второй действующий заказ.
+	var activeOrders int
+	err := tx.QueryRow(ctx, `
+		SELECT (SELECT COUNT(*) FROM orders WHERE receipt_id = r.id AND status NOT IN ('cancelled', 'expired'))
+		FROM receipt r
+		WHERE r.id = $1
+		FOR UPDATE OF r`, order.ReceiptID).Scan(&activeOrders)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error loading query names: %v", err), http.StatusInternalServerError)
-		return
+		return err
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(names); err != nil {
-		http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
-		return
+	if activeOrders > 0 {
+		return errReceiptHasOrder
 	}
-}
 
-func getEnv(key, defaultValue string) string {
-	if value, exists := os.LookupEnv(key); exists {
-		return value
+	plan, err := planOrderLines(ctx, tx, order.ReceiptID, nil, orderDate)
+	if err != nil {
+		return err
 	}
-	return defaultValue
-}
 
-func executeQuery(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	query := vars["query"]
+	status := StatusInProduction
+	if !plan.waiting && len(plan.jobs) == 0 {
+		status = StatusReady
+	}
 
-	params := r.URL.Query()
-	result, err := performQuery(query, params)
+	productionDate := plan.productionDate
+	order.Status = status
+	order.ProductionDate = productionDate.Format("2006-01-02 15:04:05")
+	err = tx.QueryRow(ctx,
+		`INSERT INTO orders (customer_id, receipt_id, order_date, production_date, status, approved_by)
+		 VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')) RETURNING id`,
+		order.CustomerID, order.ReceiptID, orderDate, productionDate, status, order.ApprovedBy,
+	).Scan(&order.ID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(result)
+	earliest := orderDate
+	if now := wallClock(time.Now()); now.After(earliest) {
+		earliest = now
+	}
+	readyAt, err := scheduleProduction(ctx, tx, order.ID, plan.jobs, earliest)
 	if err != nil {
-		return
+		return err
+	}
+	if len(plan.jobs) > 0 && readyAt.After(productionDate) {
+		productionDate = readyAt
+		order.ProductionDate = productionDate.Format("2006-01-02 15:04:05")
+		_, err := tx.Exec(ctx, `UPDATE orders SET production_date = $1 WHERE id = $2`, productionDate, order.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Заказ принимается (accepted) и сразу уходит в производство или готов к выдаче
+	accepted := StatusAccepted
+	if err := recordStatusChange(ctx, tx, order.ID, nil, accepted, user); err != nil {
+		return err
+	}
+	if err := recordStatusChange(ctx, tx, order.ID, &accepted, status, user); err != nil {
+		return err
 	}
+	if status == StatusReady {
+		if err := storeInvoice(ctx, tx, order.ID, user); err != nil {
+			return err
+		}
+		if err := enqueueReadyNotification(ctx, tx, order.ID); err != nil {
+			return err
+		}
+	}
+
+	return reserveOrderStock(ctx, tx, order.ID, plan)
 }
 
-func performQuery(queryID string, params url.Values) (*QueryResult, error) {
-	query, err := loadQueryFromFile(fmt.Sprintf("queries/%s.sql", queryID))
+// planOrderLines планирует строки рецепта receiptID, кроме лекарств из
+// covered, которые уже зарезервированы или изготавливаются. Готовый
+// медикамент резервируется при достаточном остатке; лекарство аптечного
+// изготовления ставится в расписание, если хватает всех веществ; остальные
+// строки ждут поставки неделю после orderDate.
+func planOrderLines(ctx context.Context, tx pgx.Tx, receiptID int, covered map[int]bool, orderDate time.Time) (orderPlan, error) {
+	plan := orderPlan{productionDate: orderDate}
+	rows, err := tx.Query(ctx, `
+		SELECT ml.medicine_id, ml.quantity_used, lm.id IS NOT NULL, EXTRACT(EPOCH FROM pt.time_to_product)::bigint
+		FROM medicine_list ml
+		LEFT JOIN local_medicine lm ON lm.medicine_id = ml.medicine_id
+		LEFT JOIN production_techonology pt ON lm.production_techology = pt.id
+		WHERE ml.receipt_id = $1
+		ORDER BY ml.medicine_id`, receiptID)
 	if err != nil {
-		return nil, err
+		return plan, err
+	}
+	lines, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (orderLine, error) {
+		var line orderLine
+		err := row.Scan(&line.medicineID, &line.quantity, &line.isLocal, &line.timeToProduct)
+		return line, err
+	})
+	if err != nil {
+		return plan, err
 	}
 
-	var rows pgx.Rows
-
-	if len(params) > 0 {
-		var args []interface{}
-		args = append(args, params.Get("Тип"))
-		rows, err = db.Query(context.Background(), query, args...)
-	} else {
-		rows, err = db.Query(context.Background(), query)
+	var medicineIDs, localMedicineIDs []int
+	pending := lines[:0]
+	for _, line := range lines {
+		if covered[line.medicineID] {
+			continue
+		}
+		pending = append(pending, line)
+		medicineIDs = append(medicineIDs, line.medicineID)
+		if line.isLocal {
+			localMedicineIDs = append(localMedicineIDs, line.medicineID)
+		}
 	}
+	lines = pending
+
+	rows, err = tx.Query(ctx, `
+		SELECT lm.medicine_id, mc.substance_id, mc.required_quantity
+		FROM medicine_composition mc
+		JOIN local_medicine lm ON lm.id = mc.medicine_id
+		WHERE lm.medicine_id = ANY($1)
+		ORDER BY mc.substance_id`, localMedicineIDs)
 	if err != nil {
-		return nil, err
+		return plan, err
+	}
+	composition, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (stockItem, error) {
+		var item stockItem
+		err := row.Scan(&item.medicineID, &item.substanceID, &item.quantity)
+		return item, err
+	})
+	if err != nil {
+		return plan, err
+	}
+	var substanceIDs []int
+	for _, item := range composition {
+		substanceIDs = append(substanceIDs, item.substanceID)
 	}
-	defer rows.Close()
 
-	columns := rows.FieldDescriptions()
-	result := &QueryResult{
-		Columns: make([]string, len(columns)),
-		Rows:    make([][]interface{}, 0),
+	// Просроченные партии не выдаются, поэтому в доступный остаток не входят
+	medicineStock, err := lockAvailableStock(ctx, tx, `
+		SELECT mw.medicine_id,
+		       (SELECT COALESCE(SUM(l.quantity), 0) FROM medicine_lot l
+		        WHERE l.medicine_warehouse_id = mw.id AND l.expiration_date >= CURRENT_DATE) - mw.reserved_amount
+		FROM medicine_warehouse mw
+		WHERE mw.medicine_id = ANY($1)
+		ORDER BY mw.medicine_id
+		FOR UPDATE`, medicineIDs)
+	if err != nil {
+		return plan, err
+	}
+	substanceStock, err := lockAvailableStock(ctx, tx, `
+		SELECT sw.substance_id,
+		       (SELECT COALESCE(SUM(l.quantity), 0) FROM substance_lot l
+		        WHERE l.substance_warehouse_id = sw.id AND l.expiration_date >= CURRENT_DATE) - sw.reserved_amount
+		FROM substance_warehouse sw
+		WHERE sw.substance_id = ANY($1)
+		ORDER BY sw.substance_id
+		FOR UPDATE`, substanceIDs)
+	if err != nil {
+		return plan, err
 	}
 
-	for i, col := range columns {
-		result.Columns[i] = string(col.Name)
+	for _, line := range lines {
+		if medicineStock[line.medicineID] >= line.quantity {
+			medicineStock[line.medicineID] -= line.quantity
+			plan.medicineReservations = append(plan.medicineReservations, stockItem{medicineID: line.medicineID, quantity: line.quantity})
+			continue
+		}
+
+		if line.isLocal && line.timeToProduct != nil {
+			var needed []stockItem
+			substancesAvailable := true
+			for _, item := range composition {
+				if item.medicineID != line.medicineID {
+					continue
+				}
+				item.quantity *= line.quantity
+				if substanceStock[item.substanceID] < item.quantity {
+					substancesAvailable = false
+				}
+				needed = append(needed, item)
+			}
+			// Изготовить можно только при наличии всех веществ, иначе заказ
+			// ждёт поставки. Срок изготовления назначает планировщик.
+			if substancesAvailable {
+				plan.jobs = append(plan.jobs, productionJob{
+					medicineID: line.medicineID,
+					duration:   time.Duration(*line.timeToProduct) * time.Second,
+				})
+				for _, item := range needed {
+					substanceStock[item.substanceID] -= item.quantity
+				}
+				plan.substanceReservations = append(plan.substanceReservations, needed...)
+				continue
+			}
+		}
+
+		plan.waiting = true
+		if readyDate := orderDate.AddDate(0, 0, 7); readyDate.After(plan.productionDate) { // неделя после начала заказа
+			plan.productionDate = readyDate
+		}
 	}
+	return plan, nil
+}
 
-	for rows.Next() {
-		values, err := rows.Values()
+// reserveOrderStock резервирует под заказ медикаменты и вещества плана;
+// reserved_amount на складе увеличивает триггер trg_reserve_stock
+func reserveOrderStock(ctx context.Context, tx pgx.Tx, orderID int, plan orderPlan) error {
+	for _, item := range plan.medicineReservations {
+		_, err := tx.Exec(ctx, `INSERT INTO stock_reservation (order_id, medicine_id, quantity) VALUES ($1, $2, $3)`,
+			orderID, item.medicineID, item.quantity)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		result.Rows = append(result.Rows, values)
 	}
+	for _, item := range plan.substanceReservations {
+		_, err := tx.Exec(ctx, `INSERT INTO stock_reservation (order_id, substance_id, quantity) VALUES ($1, $2, $3)`,
+			orderID, item.substanceID, item.quantity)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if rows.Err() != nil {
-		return nil, rows.Err()
+// replanWaitingOrders повторно планирует заказы в производстве, строки
+// которых ждут поставки, и возвращает число заказов, получивших резерв или
+// слот изготовления. Вызывается в транзакции приёмки, поэтому заказы видят
+// только что поступившие партии; раньше оформленные заказы планируются первыми.
+// Заказ, изготовление которого не помещается в расписание, остаётся ждать.
+func replanWaitingOrders(ctx context.Context, tx pgx.Tx) (int, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT o.id, o.receipt_id
+		FROM orders o
+		WHERE o.status = $1
+		  AND EXISTS (
+		      SELECT 1 FROM medicine_list ml
+		      WHERE ml.receipt_id = o.receipt_id
+		        AND NOT EXISTS (
+		            SELECT 1 FROM stock_reservation sr
+		            WHERE sr.order_id = o.id AND sr.medicine_id = ml.medicine_id)
+		        AND NOT EXISTS (
+		            SELECT 1 FROM production_slot ps
+		            WHERE ps.order_id = o.id AND ps.medicine_id = ml.medicine_id))
+		ORDER BY o.order_date, o.id
+		FOR UPDATE OF o`, StatusInProduction)
+	if err != nil {
+		return 0, err
+	}
+	waiting, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) ([2]int, error) {
+		var ids [2]int
+		err := row.Scan(&ids[0], &ids[1])
+		return ids, err
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	return result, nil
+	replanned := 0
+	for _, ids := range waiting {
+		// Каждый заказ планируется в своей точке сохранения: если его нельзя
+		// поставить в расписание, откатывается только он
+		sp, err := tx.Begin(ctx)
+		if err != nil {
+			return replanned, err
+		}
+		done, err := replanOrder(ctx, sp, ids[0], ids[1])
+		var scheduleErr *scheduleError
+		if errors.As(err, &scheduleErr) {
+			log.Printf("Order %d is still waiting: %v\n", ids[0], err)
+			if err := sp.Rollback(ctx); err != nil {
+				return replanned, err
+			}
+			continue
+		}
+		if err != nil {
+			sp.Rollback(ctx)
+			return replanned, err
+		}
+		if err := sp.Commit(ctx); err != nil {
+			return replanned, err
+		}
+		if done {
+			replanned++
+		}
+	}
+	return replanned, nil
 }
 
-func loadQueryFromFile(filePath string) (string, error) {
-	content, err := os.ReadFile(filePath)
+// replanOrder резервирует и ставит в расписание ожидающие строки заказа.
+// Пока остаются строки без резерва и слота, срок готовности не сокращается.
+func replanOrder(ctx context.Context, tx pgx.Tx, orderID, receiptID int) (bool, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT medicine_id FROM stock_reservation WHERE order_id = $1 AND medicine_id IS NOT NULL
+		UNION
+		SELECT medicine_id FROM production_slot WHERE order_id = $1`, orderID)
 	if err != nil {
-		return "", err
+		return false, err
 	}
-	return string(content), nil
+	coveredIDs, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return false, err
+	}
+	covered := make(map[int]bool, len(coveredIDs))
+	for _, id := range coveredIDs {
+		covered[id] = true
+	}
+
+	now := wallClock(time.Now())
+	plan, err := planOrderLines(ctx, tx, receiptID, covered, now)
+	if err != nil {
+		return false, err
+	}
+	if len(plan.medicineReservations) == 0 && len(plan.jobs) == 0 {
+		return false, nil
+	}
+
+	readyAt, err := scheduleProduction(ctx, tx, orderID, plan.jobs, now)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE orders
+		SET production_date = CASE WHEN $3 THEN GREATEST(production_date, $2) ELSE $2 END
+		WHERE id = $1`, orderID, readyAt, plan.waiting)
+	if err != nil {
+		return false, err
+	}
+	return true, reserveOrderStock(ctx, tx, orderID, plan)
 }
 
-func loadQueryNamesFromFile(filePath string) ([]string, error) {
-	content, err := os.ReadFile(filePath)
+// lockAvailableStock блокирует строки склада и возвращает доступный остаток по id
+func lockAvailableStock(ctx context.Context, tx pgx.Tx, query string, ids []int) (map[int]float64, error) {
+	rows, err := tx.Query(ctx, query, ids)
 	if err != nil {
 		return nil, err
 	}
-	return strings.Split(strings.TrimSpace(string(content)), "\n"), nil
+	defer rows.Close()
+
+	stock := make(map[int]float64)
+	for rows.Next() {
+		var id int
+		var available float64
+		if err := rows.Scan(&id, &available); err != nil {
+			return nil, err
+		}
+		stock[id] += available
+	}
+	return stock, rows.Err()
 }
 
-func queryHandler(w http.ResponseWriter, r *http.Request) {
-	var req QueryRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+// createReceipt создаёт рецепт вместе со строками medicine_list в одной
+// транзакции. Остатки склада рецепт не меняет: медикаменты резервируются при
+// оформлении заказа (placeOrder) и списываются при его выдаче. Возвращает
+// рецепт с врачом, пациентом и лекарствами.
+func createReceipt(w http.ResponseWriter, r *http.Request) {
+	var receipt Receipt
+	if err := json.NewDecoder(r.Body).Decode(&receipt); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	query := req.Query
-	params := req.Params
-
-	var args []interface{}
-	for _, param := range params {
-		args = append(args, param)
+	for _, line := range receipt.Medicines {
+		if line.QuantityUsed <= 0 {
+			http.Error(w, fmt.Sprintf("Quantity for medicine %d must be positive", line.MedicineID), http.StatusBadRequest)
+			return
+		}
 	}
 
-	rows, err := db.Query(context.Background(), query, args...)
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
+	defer tx.Rollback(ctx)
 
-	columns := rows.FieldDescriptions()
-
-	results := QueryResult{
-		Columns: make([]string, len(columns)),
+	// Без issued_at рецепт считается выписанным сегодня
+	var issuedAt *time.Time
+	if receipt.IssuedAt != "" {
+		parsed, err := time.Parse("2006-01-02", receipt.IssuedAt)
+		if err != nil {
+			http.Error(w, "Invalid issued_at, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		issuedAt = &parsed
 	}
 
-	for i, col := range columns {
-		results.Columns[i] = string(col.Name)
+	err = tx.QueryRow(ctx,
+		`INSERT INTO receipt (doctor_id, patient_id, issued_at)
+		 VALUES ($1, $2, COALESCE($3, CURRENT_DATE)) RETURNING id`,
+		receipt.DoctorID, receipt.PatientID, issuedAt,
+	).Scan(&receipt.ID)
+	if err != nil {
+		writeReceiptError(w, err)
+		return
 	}
 
-	for rows.Next() {
-		values, err := rows.Values()
+	for _, line := range receipt.Medicines {
+		_, err := tx.Exec(ctx,
+			`INSERT INTO medicine_list (receipt_id, medicine_id, quantity_used, dosage) VALUES ($1, $2, $3, $4)`,
+			receipt.ID, line.MedicineID, line.QuantityUsed, line.Dosage)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error fetching row: %v", err), http.StatusInternalServerError)
+			writeReceiptError(w, err)
 			return
 		}
-
-		results.Rows = append(results.Rows, values)
 	}
 
-	if rows.Err() != nil {
-		http.Error(w, fmt.Sprintf("Row iteration error: %v", rows.Err()), http.StatusInternalServerError)
+	found, err := checkContraindications(ctx, tx, receipt.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(results); err != nil {
-		http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
+	blocking, warnings := blockingContraindications(found)
+	if len(blocking) > 0 {
+		writeRuleViolations(w, blocking)
 		return
 	}
-}
-
-func getOrdersHandler(w http.ResponseWriter, r *http.Request) {
-	result, err := performQuery("get_orders", nil)
+	allergies, err := checkAllergies(ctx, tx, receipt.ID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(result)
+	receipt, err = loadReceipt(ctx, tx, receipt.ID)
 	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
 		return
 	}
-}
+	receipt.Warnings = warnings
+	receipt.Allergies = allergies
 
-func createOrderHandler(w http.ResponseWriter, r *http.Request) {
-	var order map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	query := `INSERT INTO orders (customer_id, receipt_id, order_date, production_date, status) VALUES ($1, $2, $3, $4, $5) RETURNING id`
-	row := db.QueryRow(context.Background(), query, order["customer_id"], order["receipt_id"], order["order_date"], order["production_date"], order["status"])
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
 
-	var id int
-	if err := row.Scan(&id); err != nil {
+func getReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	receiptID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid receipt ID", http.StatusBadRequest)
+		return
+	}
+
+	receipt, err := loadReceipt(context.Background(), db, receiptID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
 		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(map[string]interface{}{"id": id}); err != nil {
-		http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(receipt)
+}
+
+// loadReceipt загружает рецепт целиком: врача, пациента и строки лекарств.
+func loadReceipt(ctx context.Context, q querier, receiptID int) (Receipt, error) {
+	var receipt Receipt
+	var issuedAt time.Time
+	err := q.QueryRow(ctx, `SELECT id, doctor_id, patient_id, issued_at FROM receipt WHERE id = $1`, receiptID).
+		Scan(&receipt.ID, &receipt.DoctorID, &receipt.PatientID, &issuedAt)
+	if err != nil {
+		return receipt, err
+	}
+	receipt.IssuedAt = issuedAt.Format("2006-01-02")
+
+	doctor, err := loadReceiptDoctor(ctx, q, receiptID)
+	if err != nil {
+		return receipt, err
+	}
+	patient, err := loadReceiptPatient(ctx, q, receiptID)
+	if err != nil {
+		return receipt, err
+	}
+	receipt.Doctor, receipt.Patient = &doctor, &patient
+
+	receipt.Medicines, err = loadMedicineLines(ctx, q, receiptID)
+	return receipt, err
+}
+
+func writeReceiptError(w http.ResponseWriter, err error) {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		http.Error(w, "Unknown doctor, patient or medicine", http.StatusBadRequest)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+}
+
+func createDoctor(w http.ResponseWriter, r *http.Request) {
+	var doctor Doctor
+	if err := json.NewDecoder(r.Body).Decode(&doctor); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := db.QueryRow(context.Background(),
+		`INSERT INTO doctor (surname, name, middle_name)
+		 VALUES ($1, $2, $3) RETURNING id`,
+		doctor.Surname, doctor.Name, doctor.MiddleName,
+	).Scan(&doctor.ID)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doctor)
+}
+
+func createPatient(w http.ResponseWriter, r *http.Request) {
+	var patient Patient
+	if err := json.NewDecoder(r.Body).Decode(&patient); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := db.QueryRow(context.Background(),
+		`INSERT INTO patient (surname, name, middle_name, age, diagnosis)
+		 VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		patient.Surname, patient.Name, patient.MiddleName, patient.Age, patient.Diagnosis,
+	).Scan(&patient.ID)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(patient)
+}
+
+func createCustomer(w http.ResponseWriter, r *http.Request) {
+	var customer Customer
+	if err := json.NewDecoder(r.Body).Decode(&customer); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := db.QueryRow(context.Background(),
+		`INSERT INTO customer (surname, name, middle_name, phone_number, address)
+		 VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		customer.Surname, customer.Name, customer.MiddleName, customer.PhoneNumber, customer.Address,
+	).Scan(&customer.ID)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(customer)
+}
+
+func getEnv(key, defaultValue string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return defaultValue
+}
+
+func loadQueryFromFile(filePath string) (string, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+func getOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := runQueryFile("queries/get_orders.sql", nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		return
+	}
+}
+
+// getOrderHandler возвращает один заказ. Параметр expand (customer, doctor,
+// patient, medicines или all) встраивает связанные сущности; всё читается
+// в одной транзакции REPEATABLE READ, чтобы снимок был согласованным.
+func getOrderHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	expand := make(map[string]bool)
+	for _, value := range r.URL.Query()["expand"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			switch name {
+			case "all":
+				expand["customer"], expand["doctor"], expand["patient"], expand["medicines"] = true, true, true, true
+			case "customer", "doctor", "patient", "medicines":
+				expand[name] = true
+			case "":
+			default:
+				http.Error(w, fmt.Sprintf("Unknown expand value %q", name), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	order, err := loadOrder(ctx, tx, orderID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if expand["customer"] {
+		customer, err := loadCustomer(ctx, tx, order.CustomerID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		order.Customer = &customer
+	}
+	if expand["doctor"] {
+		doctor, err := loadReceiptDoctor(ctx, tx, order.ReceiptID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		order.Doctor = &doctor
+	}
+	if expand["patient"] {
+		patient, err := loadReceiptPatient(ctx, tx, order.ReceiptID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		order.Patient = &patient
+	}
+	if expand["medicines"] {
+		order.Medicines, err = loadMedicineLines(ctx, tx, order.ReceiptID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+func loadOrder(ctx context.Context, q querier, orderID int) (Order, error) {
+	var order Order
+	var orderDate, productionDate time.Time
+	var pickedUpAt *time.Time
+	err := q.QueryRow(ctx, `
+		SELECT id, customer_id, receipt_id, order_date, production_date, status, approved_by, picked_up_at, picked_up_by,
+		       production_error
+		FROM orders
+		WHERE id = $1`, orderID,
+	).Scan(&order.ID, &order.CustomerID, &order.ReceiptID, &orderDate, &productionDate, &order.Status,
+		&order.ApprovedBy, &pickedUpAt, &order.PickedUpBy, &order.ProductionError)
+	if err != nil {
+		return order, err
+	}
+	order.OrderDate = orderDate.Format("2006-01-02")
+	order.ProductionDate = productionDate.Format("2006-01-02 15:04:05")
+	if pickedUpAt != nil {
+		formatted := pickedUpAt.Format("2006-01-02 15:04:05")
+		order.PickedUpAt = &formatted
+	}
+	return order, nil
 }
 
 func updateOrderHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	orderID := vars["id"]
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
 
 	var updatedOrder Order
 	if err := json.NewDecoder(r.Body).Decode(&updatedOrder); err != nil {
@@ -495,34 +1094,535 @@ func updateOrderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Формирование SQL запроса для обновления данных заказа в базе данных
-	query := `
-		UPDATE orders 
-		SET customer_id = $1, receipt_id = $2, order_date = $3, production_date = $4, status = $5 
-		WHERE id = $6
-	`
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
 
-	// Выполнение SQL запроса к базе данных
-	_, err := db.Exec(context.Background(), query, updatedOrder.CustomerID, updatedOrder.ReceiptID, updatedOrder.OrderDate, updatedOrder.ProductionDate, updatedOrder.Status, orderID)
+	err = tx.QueryRow(ctx, `SELECT id FROM orders WHERE id = $1 FOR UPDATE`, orderID).Scan(&orderID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	current, err := loadOrder(ctx, tx, orderID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	// Рецепт определяет резервы и расписание изготовления заказа, а срок
+	// готовности рассчитывает планировщик, поэтому меняется только
+	// покупатель. Для другого рецепта заказ отменяют и оформляют заново.
+	// Статус меняется только через проверку допустимых переходов, дата
+	// заказа фиксируется сервером при приёме и не меняется.
+	if updatedOrder.ReceiptID != 0 && updatedOrder.ReceiptID != current.ReceiptID {
+		http.Error(w, "Receipt of an order cannot be changed, cancel the order and place a new one", http.StatusConflict)
+		return
+	}
+	if updatedOrder.ProductionDate != "" {
+		productionDate, err := time.Parse("2006-01-02 15:04:05", updatedOrder.ProductionDate)
+		if err != nil {
+			http.Error(w, "Invalid production_date, expected YYYY-MM-DD HH:MM:SS", http.StatusBadRequest)
+			return
+		}
+		if productionDate.Format("2006-01-02 15:04:05") != current.ProductionDate {
+			http.Error(w, "Production date is set by the production schedule and cannot be changed", http.StatusConflict)
+			return
+		}
+	}
+
+	if updatedOrder.CustomerID != 0 && updatedOrder.CustomerID != current.CustomerID {
+		_, err := tx.Exec(ctx, `UPDATE orders SET customer_id = $1 WHERE id = $2`, updatedOrder.CustomerID, orderID)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+			http.Error(w, "Customer not found", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if updatedOrder.Status != "" && updatedOrder.Status != current.Status {
+		user, err := requestUser(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := changeOrderStatus(ctx, tx, orderID, updatedOrder.Status, user); err != nil {
+			writeOrderStatusError(w, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Отправка ответа с кодом статуса 204 (No Content) после успешного обновления заказа
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// deleteOrderHandler не удаляет заказ, а отменяет его от имени сотрудника
+// (заголовок X-User): история статусов, оплаты и возвраты остаются в базе.
 func deleteOrderHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	orderID := vars["id"]
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+	user, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	query := `DELETE FROM orders WHERE id = $1`
-	_, err := db.Exec(context.Background(), query, orderID)
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if err := changeOrderStatus(ctx, tx, orderID, StatusCancelled, user); err != nil {
+		writeOrderStatusError(w, err)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getCustomersHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(context.Background(), `
+		SELECT id, surname, name, COALESCE(middle_name, ''), COALESCE(phone_number, ''), COALESCE(address, '')
+		FROM customer
+		ORDER BY id`)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
 		return
 	}
+	defer rows.Close()
+
+	customers := make([]Customer, 0)
+	for rows.Next() {
+		var customer Customer
+		if err := rows.Scan(&customer.ID, &customer.Surname, &customer.Name, &customer.MiddleName, &customer.PhoneNumber, &customer.Address); err != nil {
+			http.Error(w, fmt.Sprintf("Error fetching row: %v", err), http.StatusInternalServerError)
+			return
+		}
+		customers = append(customers, customer)
+	}
+
+	if rows.Err() != nil {
+		http.Error(w, fmt.Sprintf("Row iteration error: %v", rows.Err()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(customers)
+}
+
+func getCustomerHandler(w http.ResponseWriter, r *http.Request) {
+	customerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+
+	customer, err := loadCustomer(context.Background(), db, customerID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(customer)
+}
+
+func updateCustomerHandler(w http.ResponseWriter, r *http.Request) {
+	customerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+
+	var customer Customer
+	if err := json.NewDecoder(r.Body).Decode(&customer); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	customer.ID = customerID
+
+	tag, err := db.Exec(context.Background(), `
+		UPDATE customer
+		SET surname = $1, name = $2, middle_name = $3, phone_number = $4, address = $5
+		WHERE id = $6`,
+		customer.Surname, customer.Name, customer.MiddleName, customer.PhoneNumber, customer.Address, customer.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(customer)
+}
+
+func deleteCustomerHandler(w http.ResponseWriter, r *http.Request) {
+	customerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+
+	// Покупателя нельзя удалить, пока на него ссылаются заказы
+	var orderCount int
+	err = db.QueryRow(context.Background(), `SELECT COUNT(*) FROM orders WHERE customer_id = $1`, customerID).Scan(&orderCount)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if orderCount > 0 {
+		http.Error(w, fmt.Sprintf("Customer %d has %d order(s) and cannot be deleted", customerID, orderCount), http.StatusConflict)
+		return
+	}
+
+	tag, err := db.Exec(context.Background(), `DELETE FROM customer WHERE id = $1`, customerID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+			http.Error(w, fmt.Sprintf("Customer %d is referenced by orders and cannot be deleted", customerID), http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+func loadCustomer(ctx context.Context, q querier, customerID int) (Customer, error) {
+	var customer Customer
+	err := q.QueryRow(ctx, `
+		SELECT id, surname, name, COALESCE(middle_name, ''), COALESCE(phone_number, ''), COALESCE(address, '')
+		FROM customer
+		WHERE id = $1`, customerID,
+	).Scan(&customer.ID, &customer.Surname, &customer.Name, &customer.MiddleName, &customer.PhoneNumber, &customer.Address)
+	return customer, err
+}
+
+func getReceiptPatientHandler(w http.ResponseWriter, r *http.Request) {
+	receiptID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid receipt ID", http.StatusBadRequest)
+		return
+	}
+
+	patient, err := loadReceiptPatient(context.Background(), db, receiptID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(patient)
+}
+
+func getReceiptDoctorHandler(w http.ResponseWriter, r *http.Request) {
+	receiptID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid receipt ID", http.StatusBadRequest)
+		return
+	}
+
+	doctor, err := loadReceiptDoctor(context.Background(), db, receiptID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doctor)
+}
+
+func getReceiptMedicinesHandler(w http.ResponseWriter, r *http.Request) {
+	receiptID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid receipt ID", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	err = db.QueryRow(context.Background(), `SELECT EXISTS(SELECT 1 FROM receipt WHERE id = $1)`, receiptID).Scan(&exists)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+
+	lines, err := loadMedicineLines(context.Background(), db, receiptID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lines)
+}
+
+func updateReceiptMedicinesHandler(w http.ResponseWriter, r *http.Request) {
+	receiptID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid receipt ID", http.StatusBadRequest)
+		return
+	}
+
+	var lines []MedicineLine
+	if err := json.NewDecoder(r.Body).Decode(&lines); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	for _, line := range lines {
+		if line.QuantityUsed <= 0 {
+			http.Error(w, fmt.Sprintf("Quantity for medicine %d must be positive", line.MedicineID), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	// Блокировка рецепта упорядочивает правку строк и оформление заказа
+	// (placeOrder). Рецепт действующего заказа не меняется: его строки уже
+	// проверены, зарезервированы и поставлены в расписание.
+	var activeOrders int
+	err = tx.QueryRow(ctx, `
+		SELECT (SELECT COUNT(*) FROM orders WHERE receipt_id = r.id AND status NOT IN ('cancelled', 'expired'))
+		FROM receipt r
+		WHERE r.id = $1
+		FOR UPDATE OF r`, receiptID).Scan(&activeOrders)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if activeOrders > 0 {
+		http.Error(w, "Receipt has an active order, cancel it before changing the medicines", http.StatusConflict)
+		return
+	}
+
+	current, err := loadMedicineLines(ctx, tx, receiptID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Строки с изменённым лекарством или количеством пересоздаются, а у
+	// остальных обновляется только способ применения
+	keep := make(map[int]bool)
+	for _, line := range lines {
+		for _, old := range current {
+			if line.ID == old.ID && line.MedicineID == old.MedicineID && line.QuantityUsed == old.QuantityUsed {
+				keep[old.ID] = true
+				if _, err := tx.Exec(ctx, `UPDATE medicine_list SET dosage = $1 WHERE id = $2`, line.Dosage, old.ID); err != nil {
+					http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+	}
+	for _, old := range current {
+		if keep[old.ID] {
+			continue
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM medicine_list WHERE id = $1`, old.ID); err != nil {
+			http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	for _, line := range lines {
+		if keep[line.ID] {
+			continue
+		}
+		_, err := tx.Exec(ctx, `INSERT INTO medicine_list (receipt_id, medicine_id, quantity_used, dosage) VALUES ($1, $2, $3, $4)`,
+			receiptID, line.MedicineID, line.QuantityUsed, line.Dosage)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	updated, err := loadMedicineLines(ctx, tx, receiptID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+func updatePatientHandler(w http.ResponseWriter, r *http.Request) {
+	patientID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid patient ID", http.StatusBadRequest)
+		return
+	}
+
+	var patient Patient
+	if err := json.NewDecoder(r.Body).Decode(&patient); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	patient.ID = patientID
+
+	tag, err := db.Exec(context.Background(), `
+		UPDATE patient
+		SET surname = $1, name = $2, middle_name = $3, age = $4, diagnosis = $5
+		WHERE id = $6`,
+		patient.Surname, patient.Name, patient.MiddleName, patient.Age, patient.Diagnosis, patient.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Patient not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(patient)
+}
+
+func updateDoctorHandler(w http.ResponseWriter, r *http.Request) {
+	doctorID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid doctor ID", http.StatusBadRequest)
+		return
+	}
+
+	var doctor Doctor
+	if err := json.NewDecoder(r.Body).Decode(&doctor); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	doctor.ID = doctorID
+
+	tag, err := db.Exec(context.Background(), `
+		UPDATE doctor
+		SET surname = $1, name = $2, middle_name = $3
+		WHERE id = $4`,
+		doctor.Surname, doctor.Name, doctor.MiddleName, doctor.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Doctor not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doctor)
+}
+
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+func loadReceiptPatient(ctx context.Context, q querier, receiptID int) (Patient, error) {
+	var patient Patient
+	err := q.QueryRow(ctx, `
+		SELECT p.id, p.surname, p.name, COALESCE(p.middle_name, ''), COALESCE(p.age, 0), COALESCE(p.diagnosis, '')
+		FROM receipt r
+		JOIN patient p ON p.id = r.patient_id
+		WHERE r.id = $1`, receiptID,
+	).Scan(&patient.ID, &patient.Surname, &patient.Name, &patient.MiddleName, &patient.Age, &patient.Diagnosis)
+	return patient, err
+}
+
+func loadReceiptDoctor(ctx context.Context, q querier, receiptID int) (Doctor, error) {
+	var doctor Doctor
+	err := q.QueryRow(ctx, `
+		SELECT d.id, d.surname, d.name, COALESCE(d.middle_name, '')
+		FROM receipt r
+		JOIN doctor d ON d.id = r.doctor_id
+		WHERE r.id = $1`, receiptID,
+	).Scan(&doctor.ID, &doctor.Surname, &doctor.Name, &doctor.MiddleName)
+	return doctor, err
+}
+
+func loadMedicineLines(ctx context.Context, q querier, receiptID int) ([]MedicineLine, error) {
+	rows, err := q.Query(ctx, `
+		SELECT ml.id, m.id, m.name, m.type, ml.quantity_used, ml.dosage
+		FROM medicine_list ml
+		JOIN medicine m ON m.id = ml.medicine_id
+		WHERE ml.receipt_id = $1
+		ORDER BY ml.id`, receiptID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := make([]MedicineLine, 0)
+	for rows.Next() {
+		var line MedicineLine
+		if err := rows.Scan(&line.ID, &line.MedicineID, &line.Name, &line.Type, &line.QuantityUsed, &line.Dosage); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	NotificationPending = "pending"
+	NotificationSent    = "sent"
+	NotificationFailed  = "failed"
+)
+
+// notificationMaxAttempts - после стольких неудачных попыток уведомление
+// получает статус failed и больше не отправляется (NOTIFICATION_MAX_ATTEMPTS)
+var notificationMaxAttempts = 5
+
+// notificationBatchSize - сколько уведомлений диспетчер отправляет за проход
+const notificationBatchSize = 20
+
+type Notification struct {
+	ID            int     `json:"id"`
+	OrderID       int     `json:"order_id"`
+	Channel       string  `json:"channel"`
+	Recipient     string  `json:"recipient"`
+	Message       string  `json:"message"`
+	Status        string  `json:"status"`
+	Attempts      int     `json:"attempts"`
+	NextAttemptAt string  `json:"next_attempt_at"`
+	LastError     *string `json:"last_error"`
+	CreatedAt     string  `json:"created_at"`
+	SentAt        *string `json:"sent_at"`
+}
+
+// Sender доставляет уведомление покупателю. Реализация для SMS-шлюза или
+// почты подключается в newSender; ошибка Send приводит к повторной попытке.
+type Sender interface {
+	Send(ctx context.Context, notification Notification) error
+}
+
+// logSender пишет уведомления в журнал сервера или в файл - для сред без
+// доступа к SMS-шлюзу.
+type logSender struct {
+	mu     sync.Mutex
+	logger *log.Logger
+}
+
+func (s *logSender) Send(ctx context.Context, notification Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger.Printf("notification #%d order=%d %s to %s: %s\n", notification.ID, notification.OrderID,
+		notification.Channel, notification.Recipient, notification.Message)
+	return nil
+}
+
+// newSender выбирает отправителя по NOTIFICATION_SENDER: log (по умолчанию)
+// или file с путём в NOTIFICATION_FILE.
+func newSender() (Sender, error) {
+	switch kind := getEnv("NOTIFICATION_SENDER", "log"); kind {
+	case "log":
+		return &logSender{logger: log.Default()}, nil
+	case "file":
+		path := getEnv("NOTIFICATION_FILE", "notifications.log")
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return &logSender{logger: log.New(file, "", log.LstdFlags)}, nil
+	default:
+		return nil, fmt.Errorf("unknown NOTIFICATION_SENDER %q", kind)
+	}
+}
+
+// enqueueReadyNotification ставит в очередь SMS покупателю о том, что заказ
+// готов к выдаче. Вызывается в транзакции смены статуса, поэтому уведомление
+// появляется тогда и только тогда, когда статус действительно сменился.
+// Покупатели без телефона уведомления не получают.
+func enqueueReadyNotification(ctx context.Context, tx pgx.Tx, orderID int) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO notification_outbox (order_id, channel, recipient, message)
+		SELECT o.id, 'sms', c.phone_number,
+		       c.name || ', ваш заказ №' || o.id || ' готов. Его можно забрать в аптеке.'
+		FROM orders o
+		JOIN customer c ON c.id = o.customer_id
+		WHERE o.id = $1 AND COALESCE(c.phone_number, '') <> ''`, orderID)
+	return err
+}
+
+// runNotificationDispatcher периодически отправляет накопившиеся уведомления,
+// пока не отменён ctx.
+func runNotificationDispatcher(ctx context.Context, sender Sender, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := dispatchNotifications(ctx, sender); err != nil {
+			log.Printf("Notification dispatcher error: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatchNotifications отправляет до notificationBatchSize уведомлений, срок
+// попытки которых наступил. Каждое уведомление отправляется и отмечается в
+// своей транзакции, поэтому ошибка на одном из них не заставит повторно
+// отправить уже доставленные.
+func dispatchNotifications(ctx context.Context, sender Sender) error {
+	for i := 0; i < notificationBatchSize; i++ {
+		dispatched, err := dispatchNextNotification(ctx, sender)
+		if err != nil || !dispatched {
+			return err
+		}
+	}
+	return nil
+}
+
+// dispatchNextNotification отправляет одно уведомление из очереди и
+// возвращает false, если отправлять нечего. Строка блокируется FOR UPDATE
+// SKIP LOCKED, так что несколько экземпляров сервера не отправят одно
+// уведомление дважды. Неудачная попытка откладывает следующую с растущей
+// паузой.
+func dispatchNextNotification(ctx context.Context, sender Sender) (bool, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, notificationSelect+`
+		WHERE status = $1 AND next_attempt_at <= CURRENT_TIMESTAMP
+		ORDER BY next_attempt_at, id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED`, NotificationPending)
+	if err != nil {
+		return false, err
+	}
+	pending, err := pgx.CollectRows(rows, scanNotification)
+	if err != nil || len(pending) == 0 {
+		return false, err
+	}
+	notification := pending[0]
+
+	if sendErr := sender.Send(ctx, notification); sendErr != nil {
+		attempts := notification.Attempts + 1
+		status := NotificationPending
+		if attempts >= notificationMaxAttempts {
+			status = NotificationFailed
+		}
+		_, err = tx.Exec(ctx, `
+			UPDATE notification_outbox
+			SET attempts = $1, status = $2, last_error = $3,
+			    next_attempt_at = CURRENT_TIMESTAMP + $4 * INTERVAL '1 minute'
+			WHERE id = $5`, attempts, status, sendErr.Error(), attempts*attempts, notification.ID)
+	} else {
+		_, err = tx.Exec(ctx, `
+			UPDATE notification_outbox
+			SET attempts = attempts + 1, status = $1, last_error = NULL, sent_at = CURRENT_TIMESTAMP
+			WHERE id = $2`, NotificationSent, notification.ID)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit(ctx)
+}
+
+func getNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(context.Background(), notificationSelect+`
+		WHERE $1 = '' OR status::text = $1
+		ORDER BY id`, r.URL.Query().Get("status"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	notifications, err := pgx.CollectRows(rows, scanNotification)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching row: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notifications)
+}
+
+// retryNotificationHandler возвращает неотправленное уведомление в очередь
+// с обнулённым счётчиком попыток.
+func retryNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	notificationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid notification ID", http.StatusBadRequest)
+		return
+	}
+
+	tag, err := db.Exec(context.Background(), `
+		UPDATE notification_outbox
+		SET status = $1, attempts = 0, next_attempt_at = CURRENT_TIMESTAMP
+		WHERE id = $2 AND status <> $3`, NotificationPending, notificationID, NotificationSent)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Notification not found or already sent", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+const notificationSelect = `
+	SELECT id, order_id, channel, recipient, message, status::text, attempts, next_attempt_at,
+	       last_error, created_at, sent_at
+	FROM notification_outbox`
+
+func scanNotification(row pgx.CollectableRow) (Notification, error) {
+	var notification Notification
+	var nextAttemptAt, createdAt time.Time
+	var sentAt *time.Time
+	err := row.Scan(&notification.ID, &notification.OrderID, &notification.Channel, &notification.Recipient,
+		&notification.Message, &notification.Status, &notification.Attempts, &nextAttemptAt,
+		&notification.LastError, &createdAt, &sentAt)
+	notification.NextAttemptAt = nextAttemptAt.Format("2006-01-02 15:04:05")
+	notification.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+	notification.SentAt = formatOptionalTime(sentAt)
+	return notification, err
+}
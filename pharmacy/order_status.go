@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	StatusAccepted     = "accepted"
+	StatusInProduction = "in_production"
+	StatusReady        = "ready"
+	StatusPickedUp     = "picked_up"
+	StatusCancelled    = "cancelled"
+	StatusExpired      = "expired"
+)
+
+// orderTransitions - допустимые переходы жизненного цикла заказа:
+// accepted → in_production → ready → picked_up, плюс отмена и истечение срока.
+var orderTransitions = map[string][]string{
+	StatusAccepted:     {StatusInProduction, StatusReady, StatusCancelled},
+	StatusInProduction: {StatusReady, StatusCancelled},
+	StatusReady:        {StatusPickedUp, StatusCancelled, StatusExpired},
+	StatusPickedUp:     {},
+	StatusCancelled:    {},
+	StatusExpired:      {},
+}
+
+type StatusChange struct {
+	ID        int     `json:"id"`
+	OrderID   int     `json:"order_id"`
+	OldStatus *string `json:"old_status"`
+	NewStatus string  `json:"new_status"`
+	ChangedAt string  `json:"changed_at"`
+	ChangedBy string  `json:"changed_by"`
+}
+
+type transitionError struct {
+	from, to string
+}
+
+func (e *transitionError) Error() string {
+	if _, known := orderTransitions[e.to]; !known {
+		return fmt.Sprintf("unknown order status %q", e.to)
+	}
+	return fmt.Sprintf("illegal order status transition %s → %s", e.from, e.to)
+}
+
+func canTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// requestUser возвращает пользователя, выполняющего запрос (заголовок X-User).
+func requestUser(r *http.Request) (string, error) {
+	user := strings.TrimSpace(r.Header.Get("X-User"))
+	if user == "" {
+		return "", errors.New("X-User header is required")
+	}
+	return user, nil
+}
+
+// changeOrderStatus переводит заказ в новый статус внутри транзакции tx,
+// проверяя допустимость перехода и записывая его в order_status_history.
+// Выдача заказа (picked_up) возможна только после полной оплаты и
+// дополнительно фиксирует время и сотрудника и списывает зарезервированные
+// медикаменты со склада, отмена возвращает внесённые оплаты, а готовность
+// (ready) фиксирует счёт и ставит в очередь уведомление покупателю.
+// При переходе в конечный статус (выдан, отменён, истёк срок) резервы
+// заказа снимаются, а его незавершённые слоты изготовления удаляются из
+// расписания технологов.
+func changeOrderStatus(ctx context.Context, tx pgx.Tx, orderID int, newStatus, user string) error {
+	var current string
+	err := tx.QueryRow(ctx, `SELECT status FROM orders WHERE id = $1 FOR UPDATE`, orderID).Scan(&current)
+	if err != nil {
+		return err
+	}
+	if !canTransition(current, newStatus) {
+		return &transitionError{from: current, to: newStatus}
+	}
+	if newStatus == StatusPickedUp {
+		if err := requireFullPayment(ctx, tx, orderID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE orders SET status = $1 WHERE id = $2`, newStatus, orderID); err != nil {
+		return err
+	}
+	if newStatus == StatusPickedUp {
+		_, err := tx.Exec(ctx, `UPDATE orders SET picked_up_at = CURRENT_TIMESTAMP, picked_up_by = $1 WHERE id = $2`, user, orderID)
+		if err != nil {
+			return err
+		}
+		// Готовые медикаменты списываются из партий вместе со снятием их резерва
+		if _, err := tx.Exec(ctx, `SELECT consume_order_medicines($1)`, orderID); err != nil {
+			return err
+		}
+	}
+	if err := recordStatusChange(ctx, tx, orderID, &current, newStatus, user); err != nil {
+		return err
+	}
+	if newStatus == StatusCancelled {
+		if err := refundOrderPayments(ctx, tx, orderID, user); err != nil {
+			return err
+		}
+	}
+	if newStatus == StatusReady {
+		if err := storeInvoice(ctx, tx, orderID, user); err != nil {
+			return err
+		}
+		if err := enqueueReadyNotification(ctx, tx, orderID); err != nil {
+			return err
+		}
+	}
+
+	if len(orderTransitions[newStatus]) == 0 {
+		// reserved_amount на складе уменьшает триггер trg_release_stock
+		if _, err := tx.Exec(ctx, `DELETE FROM stock_reservation WHERE order_id = $1`, orderID); err != nil {
+			return err
+		}
+		// Незавершённые слоты освобождают время технологов для других заказов
+		_, err := tx.Exec(ctx, `DELETE FROM production_slot WHERE order_id = $1 AND ends_at > $2`, orderID, wallClock(time.Now()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func recordStatusChange(ctx context.Context, tx pgx.Tx, orderID int, oldStatus *string, newStatus, user string) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO order_status_history (order_id, old_status, new_status, changed_by)
+		VALUES ($1, $2, $3, $4)`, orderID, oldStatus, newStatus, user)
+	return err
+}
+
+func changeOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+	user, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if err := changeOrderStatus(ctx, tx, orderID, req.Status, user); err != nil {
+		writeOrderStatusError(w, err)
+		return
+	}
+
+	order, err := loadOrder(ctx, tx, orderID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+// pickupOrderHandler выдаёт готовый заказ покупателю: фиксирует время выдачи
+// и сотрудника, выдавшего заказ (заголовок X-User).
+func pickupOrderHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+	user, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if err := changeOrderStatus(ctx, tx, orderID, StatusPickedUp, user); err != nil {
+		writeOrderStatusError(w, err)
+		return
+	}
+
+	order, err := loadOrder(ctx, tx, orderID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+func getOrderHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(context.Background(), `
+		SELECT id, order_id, old_status::text, new_status::text, changed_at, changed_by
+		FROM order_status_history
+		WHERE order_id = $1
+		ORDER BY changed_at, id`, orderID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	history, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (StatusChange, error) {
+		var change StatusChange
+		var changedAt time.Time
+		err := row.Scan(&change.ID, &change.OrderID, &change.OldStatus, &change.NewStatus, &changedAt, &change.ChangedBy)
+		change.ChangedAt = changedAt.Format("2006-01-02 15:04:05")
+		return change, err
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching row: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+func writeOrderStatusError(w http.ResponseWriter, err error) {
+	var transitionErr *transitionError
+	var balanceErr *balanceDueError
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		http.Error(w, "Order not found", http.StatusNotFound)
+	case errors.As(err, &transitionErr), errors.As(err, &balanceErr):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.As(err, &pgErr) && pgErr.Code == "P0001":
+		// RAISE EXCEPTION из consume_order_medicines: резерв не покрыт непросроченными партиями
+		http.Error(w, pgErr.Message, http.StatusConflict)
+	default:
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	PaymentKindPayment = "payment"
+	PaymentKindRefund  = "refund"
+)
+
+// paymentMethods повторяет значения перечисления payment_method из create_database.sql
+var paymentMethods = []string{"cash", "card"}
+
+type Payment struct {
+	ID      int     `json:"id"`
+	OrderID int     `json:"order_id"`
+	Kind    string  `json:"kind"`
+	Method  string  `json:"method"`
+	Amount  float64 `json:"amount"`
+	PaidAt  string  `json:"paid_at"`
+	Cashier string  `json:"cashier"`
+	Comment *string `json:"comment"`
+}
+
+// OrderBalance - расчёты по заказу: сумма счёта (итоговая или по текущим
+// ценам, см. Invoice.Final), внесённые оплаты, возвраты и остаток к оплате.
+type OrderBalance struct {
+	OrderID    int       `json:"order_id"`
+	Total      float64   `json:"total"`
+	Final      bool      `json:"final"`
+	Paid       float64   `json:"paid"`
+	Refunded   float64   `json:"refunded"`
+	BalanceDue float64   `json:"balance_due"`
+	Payments   []Payment `json:"payments"`
+}
+
+// balanceDueError - заказ нельзя выдать, пока он не оплачен полностью
+type balanceDueError struct {
+	orderID int
+	due     float64
+}
+
+func (e *balanceDueError) Error() string {
+	return fmt.Sprintf("order %d has an outstanding balance of %.2f", e.orderID, e.due)
+}
+
+// paymentError - оплата не может быть принята (заказ закрыт или сумма
+// больше остатка к оплате)
+type paymentError struct {
+	message string
+}
+
+func (e *paymentError) Error() string {
+	return e.message
+}
+
+func isPaymentMethod(value string) bool {
+	for _, method := range paymentMethods {
+		if value == method {
+			return true
+		}
+	}
+	return false
+}
+
+// loadOrderBalance считает остаток к оплате заказа. pgx.ErrNoRows - заказ не найден.
+func loadOrderBalance(ctx context.Context, q querier, orderID int) (OrderBalance, error) {
+	balance := OrderBalance{OrderID: orderID}
+	invoice, err := loadInvoice(ctx, q, orderID)
+	if err != nil {
+		return balance, err
+	}
+	balance.Total, balance.Final = invoice.Total, invoice.Final
+
+	rows, err := q.Query(ctx, `
+		SELECT id, order_id, kind::text, method::text, amount, paid_at, cashier, comment
+		FROM payment
+		WHERE order_id = $1
+		ORDER BY paid_at, id`, orderID)
+	if err != nil {
+		return balance, err
+	}
+	balance.Payments, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (Payment, error) {
+		var payment Payment
+		var paidAt time.Time
+		err := row.Scan(&payment.ID, &payment.OrderID, &payment.Kind, &payment.Method, &payment.Amount,
+			&paidAt, &payment.Cashier, &payment.Comment)
+		payment.PaidAt = paidAt.Format("2006-01-02 15:04:05")
+		return payment, err
+	})
+	if err != nil {
+		return balance, err
+	}
+
+	for _, payment := range balance.Payments {
+		if payment.Kind == PaymentKindRefund {
+			balance.Refunded += payment.Amount
+		} else {
+			balance.Paid += payment.Amount
+		}
+	}
+	balance.Paid = roundMoney(balance.Paid)
+	balance.Refunded = roundMoney(balance.Refunded)
+	balance.BalanceDue = roundMoney(balance.Total - balance.Paid + balance.Refunded)
+	return balance, nil
+}
+
+// requireFullPayment не даёт выдать заказ с непогашенным остатком.
+func requireFullPayment(ctx context.Context, tx pgx.Tx, orderID int) error {
+	balance, err := loadOrderBalance(ctx, tx, orderID)
+	if err != nil {
+		return err
+	}
+	if balance.BalanceDue > 0 {
+		return &balanceDueError{orderID: orderID, due: balance.BalanceDue}
+	}
+	return nil
+}
+
+// refundOrderPayments возвращает при отмене заказа всё внесённое тем же
+// способом, которым оно было оплачено.
+func refundOrderPayments(ctx context.Context, tx pgx.Tx, orderID int, user string) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO payment (order_id, kind, method, amount, cashier, comment)
+		SELECT order_id, 'refund', method,
+		       SUM(CASE WHEN kind = 'refund' THEN -amount ELSE amount END), $2, 'Order cancelled'
+		FROM payment
+		WHERE order_id = $1
+		GROUP BY order_id, method
+		HAVING SUM(CASE WHEN kind = 'refund' THEN -amount ELSE amount END) > 0`, orderID, user)
+	return err
+}
+
+// refundOverpayment возвращает переплату, если зафиксированный счёт оказался
+// меньше внесённых предоплат (цены снизились после приёма заказа). Деньги
+// возвращаются способами последних оплат.
+func refundOverpayment(ctx context.Context, tx pgx.Tx, orderID int, user string) error {
+	balance, err := loadOrderBalance(ctx, tx, orderID)
+	if err != nil {
+		return err
+	}
+	overpaid := -balance.BalanceDue
+	if overpaid <= 0 {
+		return nil
+	}
+
+	// net - сколько внесено каждым способом за вычетом прежних возвратов
+	net := make(map[string]float64)
+	for _, payment := range balance.Payments {
+		if payment.Kind == PaymentKindRefund {
+			net[payment.Method] -= payment.Amount
+		} else {
+			net[payment.Method] += payment.Amount
+		}
+	}
+	for i := len(balance.Payments) - 1; i >= 0 && overpaid > 0; i-- {
+		method := balance.Payments[i].Method
+		amount := roundMoney(math.Min(overpaid, net[method]))
+		if balance.Payments[i].Kind != PaymentKindPayment || amount <= 0 {
+			continue
+		}
+		_, err := tx.Exec(ctx, `
+			INSERT INTO payment (order_id, kind, method, amount, cashier, comment)
+			VALUES ($1, $2, $3, $4, $5, 'Overpayment after final pricing')`,
+			orderID, PaymentKindRefund, method, amount, user)
+		if err != nil {
+			return err
+		}
+		net[method] -= amount
+		overpaid = roundMoney(overpaid - amount)
+	}
+	return nil
+}
+
+func getOrderPaymentsHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	balance, err := loadOrderBalance(context.Background(), db, orderID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(balance)
+}
+
+// createPaymentHandler принимает оплату или предоплату по заказу от кассира
+// (заголовок X-User). Сумма не может превышать остаток к оплате.
+func createPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+	user, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var payment Payment
+	if err := json.NewDecoder(r.Body).Decode(&payment); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !isPaymentMethod(payment.Method) {
+		http.Error(w, fmt.Sprintf("Invalid method, expected one of %v", paymentMethods), http.StatusBadRequest)
+		return
+	}
+	payment.Amount = roundMoney(payment.Amount)
+	if payment.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	balance, err := acceptPayment(ctx, tx, orderID, payment, user)
+	if err != nil {
+		writePaymentError(w, err)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(balance)
+}
+
+func acceptPayment(ctx context.Context, tx pgx.Tx, orderID int, payment Payment, user string) (OrderBalance, error) {
+	// Блокировка заказа упорядочивает оплаты, выдачу и отмену
+	var status string
+	if err := tx.QueryRow(ctx, `SELECT status FROM orders WHERE id = $1 FOR UPDATE`, orderID).Scan(&status); err != nil {
+		return OrderBalance{}, err
+	}
+	if len(orderTransitions[status]) == 0 {
+		return OrderBalance{}, &paymentError{fmt.Sprintf("order is %s and no longer accepts payments", status)}
+	}
+
+	balance, err := loadOrderBalance(ctx, tx, orderID)
+	if err != nil {
+		return balance, err
+	}
+	if payment.Amount > balance.BalanceDue {
+		return balance, &paymentError{fmt.Sprintf("amount %.2f exceeds the balance due %.2f", payment.Amount, balance.BalanceDue)}
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO payment (order_id, kind, method, amount, cashier, comment)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		orderID, PaymentKindPayment, payment.Method, payment.Amount, user, payment.Comment)
+	if err != nil {
+		return balance, err
+	}
+	return loadOrderBalance(ctx, tx, orderID)
+}
+
+func writePaymentError(w http.ResponseWriter, err error) {
+	var paymentErr *paymentError
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		http.Error(w, "Order not found", http.StatusNotFound)
+	case errors.As(err, &paymentErr):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	PurchaseDraft             = "draft"
+	PurchaseSent              = "sent"
+	PurchasePartiallyReceived = "partially_received"
+	PurchaseReceived          = "received"
+)
+
+type Supplier struct {
+	ID          int     `json:"id"`
+	Name        string  `json:"name"`
+	PhoneNumber *string `json:"phone_number"`
+	Email       *string `json:"email"`
+	Address     *string `json:"address"`
+}
+
+type PurchaseOrder struct {
+	ID         int                 `json:"id"`
+	SupplierID int                 `json:"supplier_id"`
+	Status     string              `json:"status"`
+	CreatedAt  string              `json:"created_at"`
+	CreatedBy  string              `json:"created_by"`
+	SentAt     *string             `json:"sent_at"`
+	ReceivedAt *string             `json:"received_at"`
+	Lines      []PurchaseOrderLine `json:"lines,omitempty"`
+}
+
+// PurchaseOrderLine ссылается ровно на одну строку склада: лекарств
+// (medicine_warehouse_id) или веществ (substance_warehouse_id).
+type PurchaseOrderLine struct {
+	ID                   int      `json:"id"`
+	MedicineWarehouseID  *int     `json:"medicine_warehouse_id,omitempty"`
+	SubstanceWarehouseID *int     `json:"substance_warehouse_id,omitempty"`
+	Name                 string   `json:"name"`
+	Quantity             float64  `json:"quantity"`
+	ReceivedQuantity     float64  `json:"received_quantity"`
+	Price                *float64 `json:"price"`
+}
+
+// purchaseStateError - действие недопустимо в текущем статусе закупки
+type purchaseStateError struct {
+	status, action string
+}
+
+func (e *purchaseStateError) Error() string {
+	return fmt.Sprintf("cannot %s a purchase order in status %s", e.action, e.status)
+}
+
+func getSuppliersHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(context.Background(),
+		`SELECT id, name, phone_number, email, address FROM supplier ORDER BY id`)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	suppliers, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Supplier, error) {
+		var supplier Supplier
+		err := row.Scan(&supplier.ID, &supplier.Name, &supplier.PhoneNumber, &supplier.Email, &supplier.Address)
+		return supplier, err
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching row: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suppliers)
+}
+
+func createSupplierHandler(w http.ResponseWriter, r *http.Request) {
+	var supplier Supplier
+	if err := json.NewDecoder(r.Body).Decode(&supplier); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if supplier.Name == "" {
+		http.Error(w, "Supplier name is required", http.StatusBadRequest)
+		return
+	}
+
+	err := db.QueryRow(context.Background(),
+		`INSERT INTO supplier (name, phone_number, email, address)
+		 VALUES ($1, $2, $3, $4) RETURNING id`,
+		supplier.Name, supplier.PhoneNumber, supplier.Email, supplier.Address,
+	).Scan(&supplier.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(supplier)
+}
+
+// getShortagesHandler возвращает позиции склада, которые пора закупить
+// (параметр types ограничивает лекарства категориями, как в отчёте 7).
+func getShortagesHandler(w http.ResponseWriter, r *http.Request) {
+	types, err := shortageTypes(r.URL.Query()["types"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := runQueryFile("queries/purchase_shortages.sql", []interface{}{types})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func shortageTypes(values []string) ([]string, error) {
+	types := make([]string, 0, len(values))
+	for _, value := range values {
+		if !isMedicineType(value) {
+			return nil, fmt.Errorf("unknown medicine type %q", value)
+		}
+		types = append(types, value)
+	}
+	return types, nil
+}
+
+func getPurchaseOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(context.Background(), `
+		SELECT id, supplier_id, status::text, created_at, created_by, sent_at, received_at
+		FROM purchase_order
+		WHERE $1 = '' OR status::text = $1
+		ORDER BY id`, r.URL.Query().Get("status"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	orders, err := pgx.CollectRows(rows, scanPurchaseOrder)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching row: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+func getPurchaseOrderHandler(w http.ResponseWriter, r *http.Request) {
+	purchaseID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid purchase order ID", http.StatusBadRequest)
+		return
+	}
+
+	order, err := loadPurchaseOrder(context.Background(), db, purchaseID)
+	if err != nil {
+		writePurchaseOrderError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+// createPurchaseOrderHandler создаёт черновик закупки. Строки передаются явно
+// или, при from_shortages, заполняются недостающими позициями склада
+// (queries/purchase_shortages.sql) с предлагаемым количеством.
+func createPurchaseOrderHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		SupplierID    int                 `json:"supplier_id"`
+		FromShortages bool                `json:"from_shortages"`
+		Types         []string            `json:"types"`
+		Lines         []PurchaseOrderLine `json:"lines"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	types, err := shortageTypes(req.Types)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	lines := req.Lines
+	if req.FromShortages {
+		shortages, err := loadShortageLines(ctx, tx, types)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		lines = append(lines, shortages...)
+	}
+	if len(lines) == 0 {
+		http.Error(w, "Purchase order has no lines", http.StatusBadRequest)
+		return
+	}
+	for _, line := range lines {
+		if (line.MedicineWarehouseID == nil) == (line.SubstanceWarehouseID == nil) {
+			http.Error(w, "Each line must reference either medicine_warehouse_id or substance_warehouse_id", http.StatusBadRequest)
+			return
+		}
+		if line.Quantity <= 0 {
+			http.Error(w, "Line quantity must be positive", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var purchaseID int
+	err = tx.QueryRow(ctx,
+		`INSERT INTO purchase_order (supplier_id, created_by) VALUES ($1, $2) RETURNING id`,
+		req.SupplierID, user).Scan(&purchaseID)
+	if err != nil {
+		writePurchaseOrderError(w, err)
+		return
+	}
+	for _, line := range lines {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO purchase_order_line (purchase_order_id, medicine_warehouse_id, substance_warehouse_id, quantity, price)
+			VALUES ($1, $2, $3, $4, $5)`,
+			purchaseID, line.MedicineWarehouseID, line.SubstanceWarehouseID, line.Quantity, line.Price)
+		if err != nil {
+			writePurchaseOrderError(w, err)
+			return
+		}
+	}
+
+	order, err := loadPurchaseOrder(ctx, tx, purchaseID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(order)
+}
+
+func loadShortageLines(ctx context.Context, q querier, types []string) ([]PurchaseOrderLine, error) {
+	query, err := loadQueryFromFile("queries/purchase_shortages.sql")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.Query(ctx, query, types)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (PurchaseOrderLine, error) {
+		var line PurchaseOrderLine
+		var kind string
+		var warehouseID int
+		var medicineType *string
+		var available, criticalLimit, onOrder float64
+		err := row.Scan(&kind, &warehouseID, &line.Name, &medicineType, &available, &criticalLimit, &onOrder, &line.Quantity)
+		if kind == "medicine" {
+			line.MedicineWarehouseID = &warehouseID
+		} else {
+			line.SubstanceWarehouseID = &warehouseID
+		}
+		return line, err
+	})
+}
+
+// sendPurchaseOrderHandler отправляет черновик поставщику (draft → sent).
+func sendPurchaseOrderHandler(w http.ResponseWriter, r *http.Request) {
+	purchaseID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid purchase order ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockPurchaseOrder(ctx, tx, purchaseID, "send", PurchaseDraft); err != nil {
+		writePurchaseOrderError(w, err)
+		return
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE purchase_order SET status = $1, sent_at = CURRENT_TIMESTAMP WHERE id = $2`,
+		PurchaseSent, purchaseID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	order, err := loadPurchaseOrder(ctx, tx, purchaseID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+// receivePurchaseOrderLine учитывает поступление quantity по строке закупки
+// (сам приход на склад проводит приёмка, см. receiving.go): увеличивает
+// received_quantity и переводит закупку в partially_received или, если
+// получено всё, в received. Получить больше заказанного по строке нельзя:
+// излишек оформляется приёмкой без ссылки на закупку.
+func receivePurchaseOrderLine(ctx context.Context, tx pgx.Tx, purchaseID, lineID int, quantity float64) error {
+	if err := lockPurchaseOrder(ctx, tx, purchaseID, "receive", PurchaseSent, PurchasePartiallyReceived); err != nil {
+		return err
+	}
+
+	var remaining float64
+	err := tx.QueryRow(ctx, `
+		SELECT quantity - received_quantity FROM purchase_order_line WHERE id = $1`, lineID,
+	).Scan(&remaining)
+	if err != nil {
+		return err
+	}
+	if quantity > remaining {
+		return &receivingError{fmt.Sprintf("purchase order line %d: receiving %g exceeds the remaining %g", lineID, quantity, remaining)}
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE purchase_order_line SET received_quantity = received_quantity + $1
+		WHERE id = $2`, quantity, lineID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE purchase_order po
+		SET status = CASE WHEN fully.received THEN $2::purchase_order_status ELSE $3::purchase_order_status END,
+		    received_at = CASE WHEN fully.received THEN CURRENT_TIMESTAMP END
+		FROM (SELECT bool_and(received_quantity >= quantity) AS received
+		      FROM purchase_order_line
+		      WHERE purchase_order_id = $1) fully
+		WHERE po.id = $1`, purchaseID, PurchaseReceived, PurchasePartiallyReceived)
+	return err
+}
+
+// deletePurchaseOrderHandler удаляет закупку, пока она не отправлена поставщику.
+func deletePurchaseOrderHandler(w http.ResponseWriter, r *http.Request) {
+	purchaseID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid purchase order ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockPurchaseOrder(ctx, tx, purchaseID, "delete", PurchaseDraft); err != nil {
+		writePurchaseOrderError(w, err)
+		return
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM purchase_order WHERE id = $1`, purchaseID); err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lockPurchaseOrder блокирует закупку и проверяет, что action допустимо в её
+// текущем статусе (один из allowed).
+func lockPurchaseOrder(ctx context.Context, tx pgx.Tx, purchaseID int, action string, allowed ...string) error {
+	var status string
+	err := tx.QueryRow(ctx, `SELECT status::text FROM purchase_order WHERE id = $1 FOR UPDATE`, purchaseID).Scan(&status)
+	if err != nil {
+		return err
+	}
+	for _, s := range allowed {
+		if status == s {
+			return nil
+		}
+	}
+	return &purchaseStateError{status: status, action: action}
+}
+
+func loadPurchaseOrder(ctx context.Context, q querier, purchaseID int) (PurchaseOrder, error) {
+	rows, err := q.Query(ctx, `
+		SELECT id, supplier_id, status::text, created_at, created_by, sent_at, received_at
+		FROM purchase_order
+		WHERE id = $1`, purchaseID)
+	if err != nil {
+		return PurchaseOrder{}, err
+	}
+	order, err := pgx.CollectOneRow(rows, scanPurchaseOrder)
+	if err != nil {
+		return PurchaseOrder{}, err
+	}
+
+	rows, err = q.Query(ctx, `
+		SELECT pol.id, pol.medicine_warehouse_id, pol.substance_warehouse_id, COALESCE(m.name, s.name),
+		       pol.quantity, pol.received_quantity, pol.price
+		FROM purchase_order_line pol
+		         LEFT JOIN medicine_warehouse mw ON mw.id = pol.medicine_warehouse_id
+		         LEFT JOIN medicine m ON m.id = mw.medicine_id
+		         LEFT JOIN substance_warehouse sw ON sw.id = pol.substance_warehouse_id
+		         LEFT JOIN substance s ON s.id = sw.substance_id
+		WHERE pol.purchase_order_id = $1
+		ORDER BY pol.id`, purchaseID)
+	if err != nil {
+		return PurchaseOrder{}, err
+	}
+	order.Lines, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (PurchaseOrderLine, error) {
+		var line PurchaseOrderLine
+		err := row.Scan(&line.ID, &line.MedicineWarehouseID, &line.SubstanceWarehouseID, &line.Name,
+			&line.Quantity, &line.ReceivedQuantity, &line.Price)
+		return line, err
+	})
+	return order, err
+}
+
+func scanPurchaseOrder(row pgx.CollectableRow) (PurchaseOrder, error) {
+	var order PurchaseOrder
+	var createdAt time.Time
+	var sentAt, receivedAt *time.Time
+	err := row.Scan(&order.ID, &order.SupplierID, &order.Status, &createdAt, &order.CreatedBy, &sentAt, &receivedAt)
+	order.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+	order.SentAt = formatOptionalTime(sentAt)
+	order.ReceivedAt = formatOptionalTime(receivedAt)
+	return order, err
+}
+
+func formatOptionalTime(t *time.Time) *string {
+	if t == nil {
+		return nil
+	}
+	formatted := t.Format("2006-01-02 15:04:05")
+	return &formatted
+}
+
+func writePurchaseOrderError(w http.ResponseWriter, err error) {
+	var stateErr *purchaseStateError
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		http.Error(w, "Purchase order not found", http.StatusNotFound)
+	case errors.As(err, &stateErr):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.As(err, &pgErr) && pgErr.Code == "23503":
+		http.Error(w, "Unknown supplier or warehouse row", http.StatusBadRequest)
+	default:
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+	}
+}
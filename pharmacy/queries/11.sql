@@ -0,0 +1,12 @@
+SELECT m.name AS medicine_name,
+       m.price AS medicine_price,
+       s.name AS substance_name,
+       mc.required_quantity,
+       s.price AS substance_price,
+       mc.required_quantity * s.price AS component_cost
+FROM medicine m
+         LEFT JOIN local_medicine lm ON m.id = lm.medicine_id
+         LEFT JOIN medicine_composition mc ON lm.id = mc.medicine_id
+         LEFT JOIN substance s ON mc.substance_id = s.id
+WHERE m.name = $1
+ORDER BY s.name;
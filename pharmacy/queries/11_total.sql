@@ -0,0 +1,10 @@
+SELECT m.name AS medicine_name,
+       m.price AS medicine_price,
+       COUNT(mc.id) AS component_count,
+       COALESCE(SUM(mc.required_quantity * s.price), 0) AS components_cost
+FROM medicine m
+         LEFT JOIN local_medicine lm ON m.id = lm.medicine_id
+         LEFT JOIN medicine_composition mc ON lm.id = mc.medicine_id
+         LEFT JOIN substance s ON mc.substance_id = s.id
+WHERE m.name = $1
+GROUP BY m.id, m.name, m.price;
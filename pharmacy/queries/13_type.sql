@@ -3,7 +3,7 @@ SELECT m.name,
        mw.total_amount,
        m.type AS medicine_type,
        pt.method_of_production,
-       pt.time_to_product
+       pt.time_to_product::text AS time_to_product
 FROM medicine m
          LEFT JOIN local_medicine lm ON m.id = lm.medicine_id
          LEFT JOIN imported_medicine im ON m.id = im.medicine_id
@@ -0,0 +1,28 @@
+SELECT 'medicine' AS kind,
+       ml.id AS lot_id,
+       m.name,
+       m.type AS medicine_type,
+       ml.lot_number,
+       ml.expiration_date,
+       ml.expiration_date - CURRENT_DATE AS days_left,
+       ml.quantity
+FROM medicine_lot ml
+         JOIN medicine_warehouse mw ON ml.medicine_warehouse_id = mw.id
+         JOIN medicine m ON mw.medicine_id = m.id
+WHERE ml.quantity > 0
+  AND ml.expiration_date <= CURRENT_DATE + $1::int
+UNION ALL
+SELECT 'substance',
+       sl.id,
+       s.name,
+       NULL,
+       sl.lot_number,
+       sl.expiration_date,
+       sl.expiration_date - CURRENT_DATE,
+       sl.quantity
+FROM substance_lot sl
+         JOIN substance_warehouse sw ON sl.substance_warehouse_id = sw.id
+         JOIN substance s ON sw.substance_id = s.id
+WHERE sl.quantity > 0
+  AND sl.expiration_date <= CURRENT_DATE + $1::int
+ORDER BY expiration_date, kind, lot_id;
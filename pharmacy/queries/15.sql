@@ -0,0 +1,39 @@
+WITH order_total AS (
+    -- Итог сохранённого счёта, а до готовности заказа - расчёт по текущим ценам
+    SELECT o.id AS order_id,
+           COALESCE(i.total,
+                    (SELECT ROUND(COALESCE(SUM(rlp.amount), 0)::numeric, 2)::float
+                     FROM receipt_line_price rlp
+                     WHERE rlp.receipt_id = o.receipt_id)) AS total
+    FROM orders o
+             LEFT JOIN invoice i ON i.order_id = o.id
+    WHERE o.status NOT IN ('picked_up', 'cancelled', 'expired')
+),
+     order_paid AS (
+         SELECT order_id,
+                SUM(CASE WHEN kind = 'refund' THEN -amount ELSE amount END) AS paid
+         FROM payment
+         GROUP BY order_id
+     ),
+     unpaid AS (
+         SELECT ot.order_id,
+                ot.total,
+                COALESCE(op.paid, 0) AS paid,
+                ROUND((ot.total - COALESCE(op.paid, 0))::numeric, 2)::float AS balance_due
+         FROM order_total ot
+                  LEFT JOIN order_paid op ON op.order_id = ot.order_id
+         WHERE ot.total - COALESCE(op.paid, 0) > 0.005
+     )
+SELECT orders.id AS order_id,
+       orders.status,
+       orders.production_date,
+       customer.surname,
+       customer.name,
+       customer.phone_number,
+       unpaid.total,
+       unpaid.paid,
+       unpaid.balance_due
+FROM unpaid
+         JOIN orders ON orders.id = unpaid.order_id
+         JOIN customer ON customer.id = orders.customer_id
+ORDER BY orders.production_date, orders.id;
@@ -1,5 +1,6 @@
 SELECT COUNT(DISTINCT customer.id)
 FROM customer
          JOIN orders ON customer.id = orders.customer_id
-WHERE orders.status = 'done'
-  AND orders.production_date < CURRENT_DATE;
\ No newline at end of file
+WHERE (orders.status IN ('ready', 'expired') AND orders.picked_up_at IS NULL
+    AND orders.production_date::date < CURRENT_DATE)
+   OR orders.picked_up_at::date > orders.production_date::date;
@@ -1,7 +1,8 @@
 SELECT substance.*, SUM(substance_usage_statistics.quantity_used) AS total_used
 FROM substance
          JOIN substance_usage_statistics ON substance.id = substance_usage_statistics.substance_id
-WHERE substance.name IN ($1)
-  AND substance_usage_statistics.usage_time BETWEEN $2 AND $3
+WHERE substance.name = ANY ($1)
+  AND substance_usage_statistics.usage_time >= $2
+  AND substance_usage_statistics.usage_time < $3::date + 1
 GROUP BY substance.id
-HAVING SUM(substance_usage_statistics.quantity_used) > 0;
\ No newline at end of file
+HAVING SUM(substance_usage_statistics.quantity_used) > 0;
@@ -0,0 +1,16 @@
+SELECT DISTINCT c.id,
+                c.surname,
+                c.name,
+                c.middle_name,
+                c.phone_number,
+                o.id AS order_id,
+                o.order_date,
+                m.name AS medicine_name,
+                m.type AS medicine_type
+FROM customer c
+         JOIN orders o ON c.id = o.customer_id
+         JOIN medicine_list ml ON o.receipt_id = ml.receipt_id
+         JOIN medicine m ON ml.medicine_id = m.id
+WHERE m.name = $1
+  AND o.order_date BETWEEN $2 AND $3
+ORDER BY o.order_date, c.id;
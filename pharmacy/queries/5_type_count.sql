@@ -0,0 +1,7 @@
+SELECT COUNT(DISTINCT c.id)
+FROM customer c
+         JOIN orders o ON c.id = o.customer_id
+         JOIN medicine_list ml ON o.receipt_id = ml.receipt_id
+         JOIN medicine m ON ml.medicine_id = m.id
+WHERE m.type = ANY ($1::medicine_type[])
+  AND o.order_date BETWEEN $2 AND $3;
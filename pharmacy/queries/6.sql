@@ -1,7 +1,15 @@
 SELECT m.name AS medicine_name,
        mw.total_amount,
+       mw.reserved_amount,
+       a.available_amount,
        mw.critical_limit,
        m.type AS medicine_type
 FROM medicine_warehouse mw
          JOIN medicine m ON mw.medicine_id = m.id
-WHERE mw.total_amount <= mw.critical_limit;
\ No newline at end of file
+         CROSS JOIN LATERAL (
+    SELECT COALESCE(SUM(l.quantity), 0) - mw.reserved_amount AS available_amount
+    FROM medicine_lot l
+    WHERE l.medicine_warehouse_id = mw.id
+      AND l.expiration_date >= CURRENT_DATE
+) a
+WHERE a.available_amount <= mw.critical_limit;
@@ -0,0 +1,63 @@
+-- Позиции склада, доступный остаток которых достиг критической нормы (как в
+-- отчёте 6), для лекарств и веществ. Доступный остаток - непросроченные
+-- партии за вычетом резерва. Предлагаемое количество доводит остаток
+-- до двух критических норм с учётом уже заказанного у поставщиков.
+-- $1 - типы лекарств (пустой массив - все типы, как в отчёте 7).
+WITH on_order AS (
+    SELECT pol.medicine_warehouse_id,
+           pol.substance_warehouse_id,
+           SUM(pol.quantity - pol.received_quantity) AS quantity
+    FROM purchase_order_line pol
+             JOIN purchase_order po ON po.id = pol.purchase_order_id
+    WHERE po.status <> 'received'
+    GROUP BY pol.medicine_warehouse_id, pol.substance_warehouse_id
+),
+shortage AS (
+    SELECT 'medicine' AS kind,
+           mw.id AS warehouse_id,
+           m.name,
+           m.type::text AS medicine_type,
+           a.available_amount,
+           mw.critical_limit::float AS critical_limit,
+           COALESCE(oo.quantity, 0) AS on_order
+    FROM medicine_warehouse mw
+             JOIN medicine m ON mw.medicine_id = m.id
+             LEFT JOIN on_order oo ON oo.medicine_warehouse_id = mw.id
+             CROSS JOIN LATERAL (
+        SELECT COALESCE(SUM(l.quantity), 0) - mw.reserved_amount AS available_amount
+        FROM medicine_lot l
+        WHERE l.medicine_warehouse_id = mw.id
+          AND l.expiration_date >= CURRENT_DATE
+    ) a
+    WHERE a.available_amount <= mw.critical_limit
+      AND (cardinality($1::text[]) = 0 OR m.type::text = ANY ($1::text[]))
+    UNION ALL
+    SELECT 'substance',
+           sw.id,
+           s.name,
+           NULL,
+           a.available_amount,
+           sw.critical_limit,
+           COALESCE(oo.quantity, 0)
+    FROM substance_warehouse sw
+             JOIN substance s ON sw.substance_id = s.id
+             LEFT JOIN on_order oo ON oo.substance_warehouse_id = sw.id
+             CROSS JOIN LATERAL (
+        SELECT COALESCE(SUM(l.quantity), 0) - sw.reserved_amount AS available_amount
+        FROM substance_lot l
+        WHERE l.substance_warehouse_id = sw.id
+          AND l.expiration_date >= CURRENT_DATE
+    ) a
+    WHERE a.available_amount <= sw.critical_limit
+)
+SELECT kind,
+       warehouse_id,
+       name,
+       medicine_type,
+       available_amount,
+       critical_limit,
+       on_order,
+       2 * critical_limit - available_amount - on_order AS suggested_quantity
+FROM shortage
+WHERE 2 * critical_limit - available_amount - on_order > 0
+ORDER BY kind, available_amount - critical_limit, warehouse_id;
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type GoodsReceipt struct {
+	ID         int                `json:"id"`
+	SupplierID int                `json:"supplier_id"`
+	ReceivedAt string             `json:"received_at"`
+	ReceivedBy string             `json:"received_by"`
+	Lines      []GoodsReceiptLine `json:"lines"`
+}
+
+// GoodsReceiptLine - поступившая партия (lot) одной позиции склада. Если
+// указана строка закупки, позиция склада берётся из неё.
+type GoodsReceiptLine struct {
+	ID                   int     `json:"id"`
+	PurchaseOrderLineID  *int    `json:"purchase_order_line_id,omitempty"`
+	MedicineWarehouseID  *int    `json:"medicine_warehouse_id,omitempty"`
+	SubstanceWarehouseID *int    `json:"substance_warehouse_id,omitempty"`
+	LotNumber            string  `json:"lot_number"`
+	Quantity             float64 `json:"quantity"`
+	UnitCost             float64 `json:"unit_cost"`
+	ExpirationDate       string  `json:"expiration_date"`
+}
+
+type StockMovement struct {
+	ID                 int     `json:"id"`
+	MedicineID         *int    `json:"medicine_id,omitempty"`
+	SubstanceID        *int    `json:"substance_id,omitempty"`
+	Name               string  `json:"name"`
+	Quantity           float64 `json:"quantity"`
+	Reason             string  `json:"reason"`
+	GoodsReceiptLineID *int    `json:"goods_receipt_line_id,omitempty"`
+	CreatedAt          string  `json:"created_at"`
+}
+
+// receivingError - приёмка не согласуется с закупкой или заполнена неверно
+type receivingError struct {
+	message string
+}
+
+func (e *receivingError) Error() string {
+	return e.message
+}
+
+// createGoodsReceiptHandler проводит приёмку поставки: каждая строка
+// увеличивает остаток склада и пишет движение в stock_movement (триггер
+// trg_book_goods_receipt_line), а строки со ссылкой на закупку учитываются
+// в ней как полученные. После приёмки заказы, ждущие поставки, планируются
+// повторно (replanWaitingOrders).
+func createGoodsReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var receipt GoodsReceipt
+	if err := json.NewDecoder(r.Body).Decode(&receipt); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(receipt.Lines) == 0 {
+		http.Error(w, "Goods receipt has no lines", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var receivedAt time.Time
+	err = tx.QueryRow(ctx,
+		`INSERT INTO goods_receipt (supplier_id, received_by) VALUES ($1, $2) RETURNING id, received_at`,
+		receipt.SupplierID, user).Scan(&receipt.ID, &receivedAt)
+	if err != nil {
+		writeGoodsReceiptError(w, err)
+		return
+	}
+	receipt.ReceivedAt = receivedAt.Format("2006-01-02 15:04:05")
+	receipt.ReceivedBy = user
+
+	for i := range receipt.Lines {
+		if err := bookGoodsReceiptLine(ctx, tx, &receipt, &receipt.Lines[i]); err != nil {
+			writeGoodsReceiptError(w, err)
+			return
+		}
+	}
+	// Поступившие остатки сразу распределяются между заказами, ждущими поставки
+	replanned, err := replanWaitingOrders(ctx, tx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if replanned > 0 {
+		log.Printf("Goods receipt %d: %d waiting order(s) replanned\n", receipt.ID, replanned)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(receipt)
+}
+
+func bookGoodsReceiptLine(ctx context.Context, tx pgx.Tx, receipt *GoodsReceipt, line *GoodsReceiptLine) error {
+	line.LotNumber = strings.TrimSpace(line.LotNumber)
+	if line.LotNumber == "" {
+		return &receivingError{"lot_number is required"}
+	}
+	if line.Quantity <= 0 {
+		return &receivingError{"quantity must be positive"}
+	}
+	if line.UnitCost < 0 {
+		return &receivingError{"unit_cost must not be negative"}
+	}
+	expirationDate, err := time.Parse("2006-01-02", line.ExpirationDate)
+	if err != nil {
+		return &receivingError{"expiration_date must be a date in YYYY-MM-DD format"}
+	}
+
+	if line.PurchaseOrderLineID != nil {
+		var purchaseID, supplierID int
+		var medicineWarehouseID, substanceWarehouseID *int
+		err := tx.QueryRow(ctx, `
+			SELECT po.id, po.supplier_id, pol.medicine_warehouse_id, pol.substance_warehouse_id
+			FROM purchase_order_line pol
+			JOIN purchase_order po ON po.id = pol.purchase_order_id
+			WHERE pol.id = $1`, *line.PurchaseOrderLineID,
+		).Scan(&purchaseID, &supplierID, &medicineWarehouseID, &substanceWarehouseID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return &receivingError{fmt.Sprintf("purchase order line %d not found", *line.PurchaseOrderLineID)}
+		}
+		if err != nil {
+			return err
+		}
+		if supplierID != receipt.SupplierID {
+			return &receivingError{fmt.Sprintf("purchase order line %d belongs to another supplier", *line.PurchaseOrderLineID)}
+		}
+		if (line.MedicineWarehouseID != nil && !sameID(line.MedicineWarehouseID, medicineWarehouseID)) ||
+			(line.SubstanceWarehouseID != nil && !sameID(line.SubstanceWarehouseID, substanceWarehouseID)) {
+			return &receivingError{fmt.Sprintf("purchase order line %d is for another warehouse item", *line.PurchaseOrderLineID)}
+		}
+		line.MedicineWarehouseID, line.SubstanceWarehouseID = medicineWarehouseID, substanceWarehouseID
+
+		if err := receivePurchaseOrderLine(ctx, tx, purchaseID, *line.PurchaseOrderLineID, line.Quantity); err != nil {
+			return err
+		}
+	}
+	if (line.MedicineWarehouseID == nil) == (line.SubstanceWarehouseID == nil) {
+		return &receivingError{"each line must reference either medicine_warehouse_id or substance_warehouse_id"}
+	}
+
+	return tx.QueryRow(ctx, `
+		INSERT INTO goods_receipt_line (goods_receipt_id, purchase_order_line_id, medicine_warehouse_id,
+		                                substance_warehouse_id, lot_number, quantity, unit_cost, expiration_date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		receipt.ID, line.PurchaseOrderLineID, line.MedicineWarehouseID, line.SubstanceWarehouseID,
+		line.LotNumber, line.Quantity, line.UnitCost, expirationDate,
+	).Scan(&line.ID)
+}
+
+func sameID(a, b *int) bool {
+	return a != nil && b != nil && *a == *b
+}
+
+func getGoodsReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	receiptID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid goods receipt ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	var receipt GoodsReceipt
+	var receivedAt time.Time
+	err = db.QueryRow(ctx,
+		`SELECT id, supplier_id, received_at, received_by FROM goods_receipt WHERE id = $1`, receiptID,
+	).Scan(&receipt.ID, &receipt.SupplierID, &receivedAt, &receipt.ReceivedBy)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Goods receipt not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	receipt.ReceivedAt = receivedAt.Format("2006-01-02 15:04:05")
+
+	rows, err := db.Query(ctx, `
+		SELECT id, purchase_order_line_id, medicine_warehouse_id, substance_warehouse_id,
+		       lot_number, quantity, unit_cost, expiration_date
+		FROM goods_receipt_line
+		WHERE goods_receipt_id = $1
+		ORDER BY id`, receiptID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	receipt.Lines, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (GoodsReceiptLine, error) {
+		var line GoodsReceiptLine
+		var expirationDate time.Time
+		err := row.Scan(&line.ID, &line.PurchaseOrderLineID, &line.MedicineWarehouseID, &line.SubstanceWarehouseID,
+			&line.LotNumber, &line.Quantity, &line.UnitCost, &expirationDate)
+		line.ExpirationDate = expirationDate.Format("2006-01-02")
+		return line, err
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching row: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
+
+// getStockMovementsHandler возвращает журнал движения остатков, по желанию
+// за период (from, to) и с отбором по причине (reason).
+func getStockMovementsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, to := time.Time{}, time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+	for name, target := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s, expected YYYY-MM-DD", name), http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+
+	rows, err := db.Query(context.Background(), `
+		SELECT sm.id, sm.medicine_id, sm.substance_id, COALESCE(m.name, s.name), sm.quantity,
+		       sm.reason::text, sm.goods_receipt_line_id, sm.created_at
+		FROM stock_movement sm
+		LEFT JOIN medicine m ON m.id = sm.medicine_id
+		LEFT JOIN substance s ON s.id = sm.substance_id
+		WHERE sm.created_at >= $1 AND sm.created_at < $2::date + 1
+		  AND ($3 = '' OR sm.reason::text = $3)
+		ORDER BY sm.created_at, sm.id`, from, to, query.Get("reason"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	movements, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (StockMovement, error) {
+		var movement StockMovement
+		var createdAt time.Time
+		err := row.Scan(&movement.ID, &movement.MedicineID, &movement.SubstanceID, &movement.Name, &movement.Quantity,
+			&movement.Reason, &movement.GoodsReceiptLineID, &createdAt)
+		movement.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		return movement, err
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching row: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(movements)
+}
+
+func writeGoodsReceiptError(w http.ResponseWriter, err error) {
+	var receivingErr *receivingError
+	var stateErr *purchaseStateError
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.As(err, &receivingErr):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.As(err, &stateErr):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.As(err, &pgErr) && pgErr.Code == "23503":
+		http.Error(w, "Unknown supplier or warehouse row", http.StatusBadRequest)
+	default:
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+	}
+}
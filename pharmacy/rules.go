@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// PrescriptionRules - настраиваемые проверки рецепта перед приёмом заказа
+// (файл PRESCRIPTION_RULES, по умолчанию prescription_rules.json). Нулевое
+// значение ограничения отключает соответствующую проверку.
+type PrescriptionRules struct {
+	// Рецепт действителен validity_days дней с даты выписки
+	ValidityDays int `json:"validity_days"`
+	// Врач, выписавший рецепт, должен быть активен
+	RequireActiveDoctor bool `json:"require_active_doctor"`
+	// Наибольшее количество одного лекарства в строке рецепта, общее и по типам
+	MaxQuantity       float64            `json:"max_quantity"`
+	MaxQuantityByType map[string]float64 `json:"max_quantity_by_type"`
+	// Лекарства этих типов отпускаются только с подтверждением (approved_by)
+	// одного из approvers; оформивший заказ сам его подтвердить не может
+	RestrictedTypes []string `json:"restricted_types"`
+	Approvers       []string `json:"approvers"`
+}
+
+var prescriptionRules = &PrescriptionRules{RequireActiveDoctor: true}
+
+// RuleViolation - нарушенное правило; MedicineID указывает строку рецепта,
+// если нарушение относится к конкретному лекарству, AllergyID - аллергию,
+// которую нужно подтвердить.
+type RuleViolation struct {
+	Rule       string `json:"rule"`
+	Message    string `json:"message"`
+	MedicineID *int   `json:"medicine_id,omitempty"`
+	AllergyID  *int   `json:"allergy_id,omitempty"`
+}
+
+func loadPrescriptionRules(path string) (*PrescriptionRules, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := &PrescriptionRules{}
+	if err := json.Unmarshal(content, rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if rules.ValidityDays < 0 || rules.MaxQuantity < 0 {
+		return nil, fmt.Errorf("%s: limits must not be negative", path)
+	}
+	for medicineType, limit := range rules.MaxQuantityByType {
+		if !isMedicineType(medicineType) {
+			return nil, fmt.Errorf("%s: unknown medicine type %q in max_quantity_by_type", path, medicineType)
+		}
+		if limit < 0 {
+			return nil, fmt.Errorf("%s: limits must not be negative", path)
+		}
+	}
+	for _, medicineType := range rules.RestrictedTypes {
+		if !isMedicineType(medicineType) {
+			return nil, fmt.Errorf("%s: unknown medicine type %q in restricted_types", path, medicineType)
+		}
+	}
+	if len(rules.RestrictedTypes) > 0 && len(rules.Approvers) == 0 {
+		return nil, fmt.Errorf("%s: approvers are required when restricted_types is set", path)
+	}
+	return rules, nil
+}
+
+// validate проверяет рецепт receiptID для заказа, который сотрудник user
+// оформляет сегодня (по часам сервера). Возвращает все нарушения сразу,
+// чтобы их можно было показать вместе; pgx.ErrNoRows - рецепт не найден.
+func (rules *PrescriptionRules) validate(ctx context.Context, q querier, receiptID int, approvedBy, user string) ([]RuleViolation, error) {
+	orderDate := truncateToDay(wallClock(time.Now()))
+	var issuedAt time.Time
+	var doctorKnown, doctorActive bool
+	err := q.QueryRow(ctx, `
+		SELECT r.issued_at, d.id IS NOT NULL, COALESCE(d.active, false)
+		FROM receipt r
+		LEFT JOIN doctor d ON d.id = r.doctor_id
+		WHERE r.id = $1`, receiptID).Scan(&issuedAt, &doctorKnown, &doctorActive)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := loadMedicineLines(ctx, q, receiptID)
+	if err != nil {
+		return nil, err
+	}
+
+	violations := make([]RuleViolation, 0)
+	add := func(rule string, medicineID *int, format string, args ...interface{}) {
+		violations = append(violations, RuleViolation{Rule: rule, Message: fmt.Sprintf(format, args...), MedicineID: medicineID})
+	}
+
+	switch {
+	case !doctorKnown:
+		add("doctor_known", nil, "prescription is not issued by a registered doctor")
+	case rules.RequireActiveDoctor && !doctorActive:
+		add("doctor_known", nil, "doctor who issued the prescription is no longer active")
+	}
+
+	if orderDate.Before(issuedAt) {
+		add("validity_period", nil, "order date %s is before the prescription date %s",
+			orderDate.Format("2006-01-02"), issuedAt.Format("2006-01-02"))
+	} else if rules.ValidityDays > 0 {
+		expiresAt := issuedAt.AddDate(0, 0, rules.ValidityDays)
+		if orderDate.After(expiresAt) {
+			add("validity_period", nil, "prescription issued on %s expired on %s",
+				issuedAt.Format("2006-01-02"), expiresAt.Format("2006-01-02"))
+		}
+	}
+
+	if len(lines) == 0 {
+		add("medicines_present", nil, "prescription has no medicines")
+	}
+	approval := rules.checkApproval(approvedBy, user)
+	for _, line := range lines {
+		medicineID := line.MedicineID
+		if line.QuantityUsed <= 0 {
+			add("quantity_positive", &medicineID, "quantity of %s must be positive", line.Name)
+		}
+		limit := rules.MaxQuantity
+		if typeLimit, ok := rules.MaxQuantityByType[line.Type]; ok {
+			limit = typeLimit
+		}
+		if limit > 0 && line.QuantityUsed > limit {
+			add("quantity_limit", &medicineID, "quantity of %s is %v, limit for %s is %v", line.Name, line.QuantityUsed, line.Type, limit)
+		}
+		if approval != "" && rules.isRestricted(line.Type) {
+			add("restricted_approval", &medicineID, "%s is a restricted %s: %s", line.Name, line.Type, approval)
+		}
+	}
+	return violations, nil
+}
+
+// checkApproval возвращает, чем подтверждение approvedBy не подходит для
+// заказа сотрудника user, или пустую строку, если подходит.
+func (rules *PrescriptionRules) checkApproval(approvedBy, user string) string {
+	approvedBy = strings.TrimSpace(approvedBy)
+	switch {
+	case approvedBy == "":
+		return "approval is required (approved_by)"
+	case strings.EqualFold(approvedBy, strings.TrimSpace(user)):
+		return fmt.Sprintf("%s cannot approve an order they place", approvedBy)
+	}
+	for _, approver := range rules.Approvers {
+		if strings.EqualFold(approvedBy, strings.TrimSpace(approver)) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%s is not an authorised approver", approvedBy)
+}
+
+func (rules *PrescriptionRules) isRestricted(medicineType string) bool {
+	for _, restricted := range rules.RestrictedTypes {
+		if restricted == medicineType {
+			return true
+		}
+	}
+	return false
+}
+
+// validateReceiptHandler проверяет рецепт заранее, не создавая заказа
+// (параметр approved_by, оформляющий сотрудник - заголовок X-User), вместе с
+// противопоказаниями и аллергиями пациента.
+func validateReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	receiptID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid receipt ID", http.StatusBadRequest)
+		return
+	}
+
+	violations, err := prescriptionRules.validate(context.Background(), db, receiptID,
+		r.URL.Query().Get("approved_by"), r.Header.Get("X-User"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	found, err := checkContraindications(context.Background(), db, receiptID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	blocking, warnings := blockingContraindications(found)
+	allergies, err := checkAllergies(context.Background(), db, receiptID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Violations []RuleViolation           `json:"violations"`
+		Warnings   []ContraindicationWarning `json:"warnings"`
+		Allergies  []AllergyWarning          `json:"allergies"`
+	}{append(violations, blocking...), warnings, allergies})
+}
+
+// writeRuleViolations отвечает 422 со списком нарушений:
+// {"error": "...", "violations": [{"rule", "message", "medicine_id"}]}.
+func writeRuleViolations(w http.ResponseWriter, violations []RuleViolation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(struct {
+		Error      string          `json:"error"`
+		Violations []RuleViolation `json:"violations"`
+	}{"Prescription does not pass validation", violations})
+}
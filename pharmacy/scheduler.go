@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// productionDayStart - начало рабочего дня технологов (PRODUCTION_DAY_START)
+var productionDayStart = 9 * time.Hour
+
+// maxScheduleDays ограничивает поиск свободного слота в расписании
+const maxScheduleDays = 365
+
+// scheduleError - изготовление нельзя поставить в расписание технологов
+type scheduleError struct {
+	message string
+}
+
+func (e *scheduleError) Error() string {
+	return e.message
+}
+
+var errNoTechnologists = &scheduleError{"no active technologists to schedule production"}
+
+type productionJob struct {
+	medicineID int
+	duration   time.Duration
+}
+
+type ProductionSlot struct {
+	ID             int    `json:"id"`
+	OrderID        int    `json:"order_id"`
+	MedicineID     int    `json:"medicine_id"`
+	MedicineName   string `json:"medicine_name"`
+	TechnologistID int    `json:"technologist_id"`
+	Technologist   string `json:"technologist"`
+	StartsAt       string `json:"starts_at"`
+	EndsAt         string `json:"ends_at"`
+}
+
+type technologistDay struct {
+	technologistID int
+	day            time.Time
+}
+
+// scheduleProduction ставит изготовление аптечных лекарств заказа в очередь
+// технологов и возвращает момент готовности последнего из них.
+//
+// Каждое изготовление занимает одного технолога на time_to_product в пределах
+// одного рабочего дня, который начинается в productionDayStart и длится
+// hours_per_day технолога. Работы внутри дня идут подряд; задание получает
+// самый ранний слот среди всех технологов, но не раньше earliest.
+// Таблица production_slot блокируется, поэтому параллельные заказы
+// планируются последовательно и не занимают одно и то же время.
+func scheduleProduction(ctx context.Context, tx pgx.Tx, orderID int, jobs []productionJob, earliest time.Time) (time.Time, error) {
+	readyAt := earliest
+	if len(jobs) == 0 {
+		return readyAt, nil
+	}
+
+	if _, err := tx.Exec(ctx, `LOCK TABLE production_slot IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return readyAt, err
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT id, EXTRACT(EPOCH FROM hours_per_day)::bigint
+		FROM technologist
+		WHERE active
+		ORDER BY id`)
+	if err != nil {
+		return readyAt, err
+	}
+	capacity := make(map[int]time.Duration)
+	var technologistIDs []int
+	for rows.Next() {
+		var id int
+		var seconds int64
+		if err := rows.Scan(&id, &seconds); err != nil {
+			rows.Close()
+			return readyAt, err
+		}
+		capacity[id] = time.Duration(seconds) * time.Second
+		technologistIDs = append(technologistIDs, id)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return readyAt, rows.Err()
+	}
+	if len(technologistIDs) == 0 {
+		return readyAt, errNoTechnologists
+	}
+
+	firstDay := truncateToDay(earliest)
+	rows, err = tx.Query(ctx, `
+		SELECT technologist_id, starts_at::date, MAX(ends_at)
+		FROM production_slot
+		WHERE starts_at >= $1
+		GROUP BY technologist_id, starts_at::date`, firstDay)
+	if err != nil {
+		return readyAt, err
+	}
+	// nextFree - момент, с которого технолог свободен в данный день
+	nextFree := make(map[technologistDay]time.Time)
+	for rows.Next() {
+		var technologistID int
+		var day, endsAt time.Time
+		if err := rows.Scan(&technologistID, &day, &endsAt); err != nil {
+			rows.Close()
+			return readyAt, err
+		}
+		nextFree[technologistDay{technologistID, truncateToDay(day)}] = endsAt
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return readyAt, rows.Err()
+	}
+
+	for _, job := range jobs {
+		technologistID, startsAt, err := findProductionSlot(job.duration, earliest, technologistIDs, capacity, nextFree)
+		if err != nil {
+			return readyAt, err
+		}
+		endsAt := startsAt.Add(job.duration)
+		nextFree[technologistDay{technologistID, truncateToDay(startsAt)}] = endsAt
+
+		_, err = tx.Exec(ctx, `
+			INSERT INTO production_slot (order_id, medicine_id, technologist_id, starts_at, ends_at)
+			VALUES ($1, $2, $3, $4, $5)`, orderID, job.medicineID, technologistID, startsAt, endsAt)
+		if err != nil {
+			return readyAt, err
+		}
+		if endsAt.After(readyAt) {
+			readyAt = endsAt
+		}
+	}
+	return readyAt, nil
+}
+
+func findProductionSlot(duration time.Duration, earliest time.Time, technologistIDs []int, capacity map[int]time.Duration, nextFree map[technologistDay]time.Time) (int, time.Time, error) {
+	fits := false
+	for _, id := range technologistIDs {
+		if capacity[id] >= duration {
+			fits = true
+		}
+	}
+	if !fits {
+		return 0, time.Time{}, &scheduleError{fmt.Sprintf("production takes %s, longer than the working day of any active technologist", duration)}
+	}
+
+	firstDay := truncateToDay(earliest)
+	for offset := 0; offset < maxScheduleDays; offset++ {
+		day := firstDay.AddDate(0, 0, offset)
+		bestID := 0
+		var bestStart time.Time
+		for _, id := range technologistIDs {
+			if capacity[id] < duration {
+				continue
+			}
+			start := day.Add(productionDayStart)
+			if free, ok := nextFree[technologistDay{id, day}]; ok && free.After(start) {
+				start = free
+			}
+			if earliest.After(start) {
+				start = earliest
+			}
+			if start.Add(duration).After(day.Add(productionDayStart + capacity[id])) {
+				continue
+			}
+			if bestID == 0 || start.Before(bestStart) {
+				bestID, bestStart = id, start
+			}
+		}
+		if bestID != 0 {
+			return bestID, bestStart, nil
+		}
+	}
+	return 0, time.Time{}, &scheduleError{fmt.Sprintf("no production slot of %s available within %d days", duration, maxScheduleDays)}
+}
+
+// wallClock переносит местное время в UTC без сдвига: колонки timestamp
+// хранятся без часового пояса и pgx читает их как UTC.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+func truncateToDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// getProductionScheduleHandler возвращает слоты изготовления на указанный день
+// (параметр date, по умолчанию сегодня).
+func getProductionScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	day := truncateToDay(wallClock(time.Now()))
+	if value := r.URL.Query().Get("date"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			http.Error(w, "Invalid date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		day = parsed
+	}
+
+	rows, err := db.Query(context.Background(), `
+		SELECT ps.id, ps.order_id, ps.medicine_id, m.name, ps.technologist_id,
+		       t.surname || ' ' || t.name, ps.starts_at, ps.ends_at
+		FROM production_slot ps
+		JOIN medicine m ON m.id = ps.medicine_id
+		JOIN technologist t ON t.id = ps.technologist_id
+		WHERE ps.starts_at >= $1 AND ps.starts_at < $1 + INTERVAL '1 day'
+		ORDER BY ps.starts_at, ps.technologist_id`, day)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	slots, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (ProductionSlot, error) {
+		var slot ProductionSlot
+		var startsAt, endsAt time.Time
+		err := row.Scan(&slot.ID, &slot.OrderID, &slot.MedicineID, &slot.MedicineName, &slot.TechnologistID,
+			&slot.Technologist, &startsAt, &endsAt)
+		slot.StartsAt = startsAt.Format("2006-01-02 15:04:05")
+		slot.EndsAt = endsAt.Format("2006-01-02 15:04:05")
+		return slot, err
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching row: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(slots)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFindProductionSlot(t *testing.T) {
+	day := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	at := func(offset int, hour, minute int) time.Time {
+		return day.AddDate(0, 0, offset).Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+	}
+	bookedDays := func(technologistID, days int, until time.Duration) map[technologistDay]time.Time {
+		nextFree := make(map[technologistDay]time.Time)
+		for offset := 0; offset < days; offset++ {
+			d := day.AddDate(0, 0, offset)
+			nextFree[technologistDay{technologistID, d}] = d.Add(until)
+		}
+		return nextFree
+	}
+
+	tests := []struct {
+		name      string
+		duration  time.Duration
+		earliest  time.Time
+		ids       []int
+		capacity  map[int]time.Duration
+		nextFree  map[technologistDay]time.Time
+		wantID    int
+		wantStart time.Time
+		wantErr   bool
+	}{
+		{
+			name:      "empty schedule starts at the beginning of the day",
+			duration:  2 * time.Hour,
+			earliest:  at(0, 7, 0),
+			ids:       []int{1, 2},
+			capacity:  map[int]time.Duration{1: 8 * time.Hour, 2: 8 * time.Hour},
+			wantID:    1,
+			wantStart: at(0, 9, 0),
+		},
+		{
+			name:      "not earlier than the order time",
+			duration:  time.Hour,
+			earliest:  at(0, 10, 30),
+			ids:       []int{1},
+			capacity:  map[int]time.Duration{1: 8 * time.Hour},
+			wantID:    1,
+			wantStart: at(0, 10, 30),
+		},
+		{
+			name:      "free technologist is preferred to a busy one",
+			duration:  time.Hour,
+			earliest:  at(0, 8, 0),
+			ids:       []int{1, 2},
+			capacity:  map[int]time.Duration{1: 8 * time.Hour, 2: 8 * time.Hour},
+			nextFree:  map[technologistDay]time.Time{{1, day}: at(0, 12, 0)},
+			wantID:    2,
+			wantStart: at(0, 9, 0),
+		},
+		{
+			name:     "earliest end of the queue among busy technologists",
+			duration: time.Hour,
+			earliest: at(0, 8, 0),
+			ids:      []int{1, 2},
+			capacity: map[int]time.Duration{1: 8 * time.Hour, 2: 8 * time.Hour},
+			nextFree: map[technologistDay]time.Time{
+				{1, day}: at(0, 14, 0),
+				{2, day}: at(0, 11, 15),
+			},
+			wantID:    2,
+			wantStart: at(0, 11, 15),
+		},
+		{
+			name:      "technologist with a shorter day is skipped",
+			duration:  5 * time.Hour,
+			earliest:  at(0, 8, 0),
+			ids:       []int{1, 2},
+			capacity:  map[int]time.Duration{1: 4 * time.Hour, 2: 8 * time.Hour},
+			wantID:    2,
+			wantStart: at(0, 9, 0),
+		},
+		{
+			name:      "job fills the working day exactly",
+			duration:  3 * time.Hour,
+			earliest:  at(0, 8, 0),
+			ids:       []int{1},
+			capacity:  map[int]time.Duration{1: 8 * time.Hour},
+			nextFree:  map[technologistDay]time.Time{{1, day}: at(0, 14, 0)},
+			wantID:    1,
+			wantStart: at(0, 14, 0),
+		},
+		{
+			name:      "job that does not fit rolls over to the next day",
+			duration:  2 * time.Hour,
+			earliest:  at(0, 8, 0),
+			ids:       []int{1},
+			capacity:  map[int]time.Duration{1: 8 * time.Hour},
+			nextFree:  map[technologistDay]time.Time{{1, day}: at(0, 16, 0)},
+			wantID:    1,
+			wantStart: at(1, 9, 0),
+		},
+		{
+			name:      "order after the end of the working day rolls over",
+			duration:  time.Hour,
+			earliest:  at(0, 16, 30),
+			ids:       []int{1},
+			capacity:  map[int]time.Duration{1: 8 * time.Hour},
+			wantID:    1,
+			wantStart: at(1, 9, 0),
+		},
+		{
+			name:     "longer than any working day",
+			duration: 9 * time.Hour,
+			earliest: at(0, 8, 0),
+			ids:      []int{1, 2},
+			capacity: map[int]time.Duration{1: 4 * time.Hour, 2: 8 * time.Hour},
+			wantErr:  true,
+		},
+		{
+			name:      "last day of the search window",
+			duration:  time.Hour,
+			earliest:  at(0, 8, 0),
+			ids:       []int{1},
+			capacity:  map[int]time.Duration{1: 8 * time.Hour},
+			nextFree:  bookedDays(1, maxScheduleDays-1, 17*time.Hour),
+			wantID:    1,
+			wantStart: at(maxScheduleDays-1, 9, 0),
+		},
+		{
+			name:     "no slot within maxScheduleDays",
+			duration: time.Hour,
+			earliest: at(0, 8, 0),
+			ids:      []int{1},
+			capacity: map[int]time.Duration{1: 8 * time.Hour},
+			nextFree: bookedDays(1, maxScheduleDays, 17*time.Hour),
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nextFree := tt.nextFree
+			if nextFree == nil {
+				nextFree = make(map[technologistDay]time.Time)
+			}
+			id, start, err := findProductionSlot(tt.duration, tt.earliest, tt.ids, tt.capacity, nextFree)
+			if tt.wantErr {
+				var scheduleErr *scheduleError
+				if !errors.As(err, &scheduleErr) {
+					t.Fatalf("expected scheduleError, got id=%d start=%v err=%v", id, start, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if id != tt.wantID || !start.Equal(tt.wantStart) {
+				t.Errorf("got technologist %d at %v, want %d at %v", id, start, tt.wantID, tt.wantStart)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// systemUser - от имени кого фоновые задания меняют статус заказа
+const systemUser = "system"
+
+// runProductionWorker периодически завершает изготовленные заказы, пока не
+// отменён ctx.
+func runProductionWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		completed, err := completeProducedOrders(ctx)
+		if completed > 0 {
+			log.Printf("Production worker: %d order(s) moved to %s\n", completed, StatusReady)
+		}
+		if err != nil {
+			log.Printf("Production worker error: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// completeProducedOrders переводит в ready все заказы, изготовление которых
+// закончено, и возвращает их количество. Заказ, который не удалось
+// завершить (например, не хватило непросроченных веществ), помечается
+// production_error и до следующего запуска пропускается, не задерживая
+// остальные заказы.
+func completeProducedOrders(ctx context.Context) (int, error) {
+	completed := 0
+	failed := make([]int, 0)
+	for {
+		orderID, err := completeNextProducedOrder(ctx, failed)
+		if orderID == 0 {
+			return completed, err
+		}
+		if err != nil {
+			log.Printf("Production worker: order %d not completed: %v\n", orderID, err)
+			if err := recordProductionError(ctx, orderID, err); err != nil {
+				return completed, err
+			}
+			failed = append(failed, orderID)
+			continue
+		}
+		completed++
+	}
+}
+
+// recordProductionError сохраняет причину, по которой заказ не удалось
+// завершить; очищается при успешном завершении.
+func recordProductionError(ctx context.Context, orderID int, cause error) error {
+	_, err := db.Exec(ctx, `UPDATE orders SET production_error = $2 WHERE id = $1`, orderID, cause.Error())
+	return err
+}
+
+// completeNextProducedOrder обрабатывает один изготовленный заказ в отдельной
+// транзакции. Заказ изготовлен, если каждое лекарство рецепта либо
+// зарезервировано на складе, либо изготовлено по расписанию, и все слоты
+// изготовления уже закончились. Заказы, ожидающие поставки, не трогаются.
+// FOR UPDATE SKIP LOCKED позволяет нескольким экземплярам сервера работать
+// одновременно, не обрабатывая один заказ дважды. Заказы из skip не
+// выбираются. Возвращает id обработанного заказа или 0, если заказов нет
+// (ошибка при этом относится к выбору заказа, а не к нему самому).
+func completeNextProducedOrder(ctx context.Context, skip []int) (int, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := wallClock(time.Now())
+	var orderID int
+	err = tx.QueryRow(ctx, `
+		SELECT o.id
+		FROM orders o
+		WHERE o.status = $1
+		  AND o.production_date <= $2
+		  AND o.id <> ALL($3)
+		  AND NOT EXISTS (
+		      SELECT 1 FROM production_slot ps
+		      WHERE ps.order_id = o.id AND ps.ends_at > $2)
+		  AND NOT EXISTS (
+		      SELECT 1 FROM medicine_list ml
+		      WHERE ml.receipt_id = o.receipt_id
+		        AND NOT EXISTS (
+		            SELECT 1 FROM stock_reservation sr
+		            WHERE sr.order_id = o.id AND sr.medicine_id = ml.medicine_id)
+		        AND NOT EXISTS (
+		            SELECT 1 FROM production_slot ps
+		            WHERE ps.order_id = o.id AND ps.medicine_id = ml.medicine_id))
+		ORDER BY o.production_date, o.id
+		LIMIT 1
+		FOR UPDATE OF o SKIP LOCKED`, StatusInProduction, now, skip).Scan(&orderID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Вещества списываются со склада вместе со снятием их резерва
+	if _, err := tx.Exec(ctx, `SELECT consume_order_substances($1)`, orderID); err != nil {
+		return orderID, err
+	}
+	if err := changeOrderStatus(ctx, tx, orderID, StatusReady, systemUser); err != nil {
+		return orderID, err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE orders SET production_error = NULL WHERE id = $1`, orderID); err != nil {
+		return orderID, err
+	}
+
+	return orderID, tx.Commit(ctx)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// writeOffReasons повторяет значения перечисления write_off_reason из create_database.sql
+var writeOffReasons = []string{"expired", "damaged", "lost", "recalled"}
+
+// WriteOff - списание части партии лекарства или вещества. Списание уменьшает
+// остаток через триггер trg_book_write_off и попадает в stock_movement, но не
+// в статистику использования по рецептам.
+type WriteOff struct {
+	ID             int     `json:"id"`
+	MedicineLotID  *int    `json:"medicine_lot_id,omitempty"`
+	SubstanceLotID *int    `json:"substance_lot_id,omitempty"`
+	Name           string  `json:"name"`
+	LotNumber      string  `json:"lot_number"`
+	Quantity       float64 `json:"quantity"`
+	Reason         string  `json:"reason"`
+	Comment        *string `json:"comment"`
+	WrittenOffAt   string  `json:"written_off_at"`
+	WrittenOffBy   string  `json:"written_off_by"`
+}
+
+func isWriteOffReason(value string) bool {
+	for _, reason := range writeOffReasons {
+		if value == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// createWriteOffHandler списывает quantity из партии. Если quantity не
+// указано, списывается весь остаток партии. Списание непросроченной партии,
+// после которого остатка не хватит на резервы заказов, отклоняется.
+func createWriteOffHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var writeOff WriteOff
+	if err := json.NewDecoder(r.Body).Decode(&writeOff); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if (writeOff.MedicineLotID == nil) == (writeOff.SubstanceLotID == nil) {
+		http.Error(w, "Either medicine_lot_id or substance_lot_id is required", http.StatusBadRequest)
+		return
+	}
+	if !isWriteOffReason(writeOff.Reason) {
+		http.Error(w, fmt.Sprintf("Invalid reason, expected one of %v", writeOffReasons), http.StatusBadRequest)
+		return
+	}
+	if writeOff.Quantity < 0 {
+		http.Error(w, "Quantity must be positive", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	// Вместе с партией блокируется строка склада, чтобы параллельный заказ не
+	// зарезервировал списываемый остаток. free - непросроченный остаток
+	// позиции за вычетом резервов заказов.
+	lotQuery := `
+		SELECT l.quantity, l.expiration_date >= CURRENT_DATE,
+		       (SELECT COALESCE(SUM(x.quantity), 0) FROM medicine_lot x
+		        WHERE x.medicine_warehouse_id = w.id AND x.expiration_date >= CURRENT_DATE) - w.reserved_amount
+		FROM medicine_lot l
+		JOIN medicine_warehouse w ON w.id = l.medicine_warehouse_id
+		WHERE l.id = $1
+		FOR UPDATE`
+	lotID := writeOff.MedicineLotID
+	if writeOff.SubstanceLotID != nil {
+		lotQuery = `
+			SELECT l.quantity, l.expiration_date >= CURRENT_DATE,
+			       (SELECT COALESCE(SUM(x.quantity), 0) FROM substance_lot x
+			        WHERE x.substance_warehouse_id = w.id AND x.expiration_date >= CURRENT_DATE) - w.reserved_amount
+			FROM substance_lot l
+			JOIN substance_warehouse w ON w.id = l.substance_warehouse_id
+			WHERE l.id = $1
+			FOR UPDATE`
+		lotID = writeOff.SubstanceLotID
+	}
+	var available, free float64
+	var unexpired bool
+	if err := tx.QueryRow(ctx, lotQuery, *lotID).Scan(&available, &unexpired, &free); err != nil {
+		writeWriteOffError(w, err)
+		return
+	}
+	if writeOff.Quantity == 0 {
+		writeOff.Quantity = available
+	}
+	if writeOff.Quantity == 0 || writeOff.Quantity > available {
+		http.Error(w, fmt.Sprintf("Lot has %v in stock, cannot write off %v", available, writeOff.Quantity), http.StatusConflict)
+		return
+	}
+	// Просроченные партии в доступный остаток не входят, и их списание
+	// резервов не затрагивает
+	if unexpired && writeOff.Quantity > free {
+		http.Error(w, fmt.Sprintf("Write-off would cut into stock reserved for orders: only %v of the item is free, cannot write off %v",
+			math.Max(free, 0), writeOff.Quantity), http.StatusConflict)
+		return
+	}
+
+	writeOffID, err := insertWriteOff(ctx, tx, writeOff, user)
+	if err != nil {
+		writeWriteOffError(w, err)
+		return
+	}
+	writeOff, err = loadWriteOff(ctx, tx, writeOffID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(writeOff)
+}
+
+// writeOffExpiredHandler списывает с причиной expired весь остаток партий,
+// срок годности которых истёк.
+func writeOffExpiredHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := requestUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		SELECT id, NULL::int, quantity FROM medicine_lot
+		WHERE quantity > 0 AND expiration_date < CURRENT_DATE
+		UNION ALL
+		SELECT NULL::int, id, quantity FROM substance_lot
+		WHERE quantity > 0 AND expiration_date < CURRENT_DATE
+		ORDER BY 1, 2`)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	expired, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (WriteOff, error) {
+		writeOff := WriteOff{Reason: "expired"}
+		err := row.Scan(&writeOff.MedicineLotID, &writeOff.SubstanceLotID, &writeOff.Quantity)
+		return writeOff, err
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching row: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeOffs := make([]WriteOff, 0, len(expired))
+	for _, writeOff := range expired {
+		writeOffID, err := insertWriteOff(ctx, tx, writeOff, user)
+		if err != nil {
+			writeWriteOffError(w, err)
+			return
+		}
+		writeOff, err = loadWriteOff(ctx, tx, writeOffID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeOffs = append(writeOffs, writeOff)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(writeOffs)
+}
+
+func getWriteOffsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(context.Background(), writeOffSelect+`
+		WHERE $1 = '' OR wo.reason::text = $1
+		ORDER BY wo.written_off_at, wo.id`, r.URL.Query().Get("reason"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeOffs, err := pgx.CollectRows(rows, scanWriteOff)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching row: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(writeOffs)
+}
+
+func insertWriteOff(ctx context.Context, tx pgx.Tx, writeOff WriteOff, user string) (int, error) {
+	var writeOffID int
+	err := tx.QueryRow(ctx, `
+		INSERT INTO write_off (medicine_lot_id, substance_lot_id, quantity, reason, comment, written_off_by)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		writeOff.MedicineLotID, writeOff.SubstanceLotID, writeOff.Quantity, writeOff.Reason, writeOff.Comment, user,
+	).Scan(&writeOffID)
+	return writeOffID, err
+}
+
+const writeOffSelect = `
+	SELECT wo.id, wo.medicine_lot_id, wo.substance_lot_id, COALESCE(m.name, s.name),
+	       COALESCE(ml.lot_number, sl.lot_number), wo.quantity, wo.reason::text, wo.comment,
+	       wo.written_off_at, wo.written_off_by
+	FROM write_off wo
+	LEFT JOIN medicine_lot ml ON ml.id = wo.medicine_lot_id
+	LEFT JOIN medicine_warehouse mw ON mw.id = ml.medicine_warehouse_id
+	LEFT JOIN medicine m ON m.id = mw.medicine_id
+	LEFT JOIN substance_lot sl ON sl.id = wo.substance_lot_id
+	LEFT JOIN substance_warehouse sw ON sw.id = sl.substance_warehouse_id
+	LEFT JOIN substance s ON s.id = sw.substance_id`
+
+func loadWriteOff(ctx context.Context, q querier, writeOffID int) (WriteOff, error) {
+	rows, err := q.Query(ctx, writeOffSelect+` WHERE wo.id = $1`, writeOffID)
+	if err != nil {
+		return WriteOff{}, err
+	}
+	return pgx.CollectOneRow(rows, scanWriteOff)
+}
+
+func scanWriteOff(row pgx.CollectableRow) (WriteOff, error) {
+	var writeOff WriteOff
+	var writtenOffAt time.Time
+	err := row.Scan(&writeOff.ID, &writeOff.MedicineLotID, &writeOff.SubstanceLotID, &writeOff.Name,
+		&writeOff.LotNumber, &writeOff.Quantity, &writeOff.Reason, &writeOff.Comment,
+		&writtenOffAt, &writeOff.WrittenOffBy)
+	writeOff.WrittenOffAt = writtenOffAt.Format("2006-01-02 15:04:05")
+	return writeOff, err
+}
+
+func writeWriteOffError(w http.ResponseWriter, err error) {
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		http.Error(w, "Lot not found", http.StatusNotFound)
+	case errors.As(err, &pgErr) && pgErr.Code == "23514":
+		// CHECK quantity >= 0 на партии: списывают больше остатка
+		http.Error(w, "Write-off exceeds the lot quantity", http.StatusConflict)
+	default:
+		http.Error(w, fmt.Sprintf("Query execution error: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -9,9 +10,15 @@ import (
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/widget"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -25,6 +32,28 @@ type QueryResult struct {
 	Rows    [][]interface{} `json:"rows"`
 }
 
+// CatalogReport - отчёт из каталога сервера (GET /catalog). Форма параметров
+// строится по Params, а Queries перечисляет варианты запроса с параметрами,
+// которые каждый из них принимает.
+type CatalogReport struct {
+	ID      string               `json:"id"`
+	Title   string               `json:"title"`
+	Params  []CatalogParam       `json:"params"`
+	Queries []CatalogReportQuery `json:"queries"`
+}
+
+type CatalogParam struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Type  string `json:"type"`
+}
+
+type CatalogReportQuery struct {
+	Name    string   `json:"name"`
+	Variant string   `json:"variant,omitempty"`
+	Params  []string `json:"params,omitempty"`
+}
+
 type Order struct {
 	ID             int    `json:"id"`
 	CustomerID     int    `json:"customer_id"`
@@ -32,6 +61,15 @@ type Order struct {
 	OrderDate      string `json:"order_date"`
 	ProductionDate string `json:"production_date"`
 	Status         string `json:"status"`
+	ApprovedBy     string `json:"approved_by,omitempty"`
+
+	Customer  *Customer      `json:"customer,omitempty"`
+	Doctor    *Doctor        `json:"doctor,omitempty"`
+	Patient   *Patient       `json:"patient,omitempty"`
+	Medicines []MedicineLine `json:"medicines,omitempty"`
+	Warnings  []Warning      `json:"warnings,omitempty"`
+
+	AcknowledgedAllergies []int `json:"acknowledged_allergies,omitempty"`
 }
 
 type Customer struct {
@@ -48,7 +86,8 @@ type Patient struct {
 	Surname    string `json:"surname"`
 	Name       string `json:"name"`
 	MiddleName string `json:"middle_name"`
-	Birthday   string `json:"birthday"`
+	Age        int    `json:"age"`
+	Diagnosis  string `json:"diagnosis"`
 }
 
 type Doctor struct {
@@ -56,20 +95,87 @@ type Doctor struct {
 	Surname    string `json:"surname"`
 	Name       string `json:"name"`
 	MiddleName string `json:"middle_name"`
-	Specialty  string `json:"specialty"`
 }
 
-type Medicine struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+type MedicineLine struct {
+	ID           int     `json:"id"`
+	MedicineID   int     `json:"medicine_id"`
+	Name         string  `json:"name"`
+	Type         string  `json:"type"`
+	QuantityUsed float64 `json:"quantity_used"`
+	Dosage       *string `json:"dosage"`
+}
+
+// orderStatuses - статусы жизненного цикла заказа; допустимость перехода
+// проверяет сервер
+var orderStatuses = []string{"in_production", "ready", "picked_up", "cancelled", "expired"}
+
+// writeOffReasons повторяет значения перечисления write_off_reason на сервере
+var writeOffReasons = []string{"expired", "damaged", "lost", "recalled"}
+
+// medicineTypes повторяет значения перечисления medicine_type на сервере
+var medicineTypes = []string{"pill", "ointment", "tincture", "mixture", "solution", "powder"}
+
+// paymentMethods повторяет значения перечисления payment_method на сервере
+var paymentMethods = []string{"cash", "card"}
+
+// currentUser передаётся серверу в заголовке X-User и попадает в историю
+// изменений заказа
+var currentUser = clientUser()
+
+func clientUser() string {
+	if user := os.Getenv("PHARMACY_USER"); user != "" {
+		return user
+	}
+	if user := os.Getenv("USER"); user != "" {
+		return user
+	}
+	return "pharmacist"
+}
+
+// labelPrinter - адрес принтера этикеток (host:port, обычно порт 9100),
+// принимающего ZPL напрямую. Текстовые этикетки печатаются на обычном
+// принтере командой printCommand, которая читает текст со стандартного ввода.
+var labelPrinter = os.Getenv("PHARMACY_LABEL_PRINTER")
+
+var printCommand = clientPrintCommand()
+
+func clientPrintCommand() string {
+	if command := strings.TrimSpace(os.Getenv("PHARMACY_PRINT_COMMAND")); command != "" {
+		return command
+	}
+	return "lp"
 }
 
 type Receipt struct {
-	ID        int `json:"id"`
-	PatientID int `json:"patient_id"`
-	DoctorID  int `json:"doctor_id"`
+	ID        int            `json:"id"`
+	PatientID int            `json:"patient_id"`
+	DoctorID  int            `json:"doctor_id"`
+	Medicines []MedicineLine `json:"medicines,omitempty"`
+	Warnings  []Warning      `json:"warnings,omitempty"`
+	Allergies []Warning      `json:"allergies,omitempty"`
+}
+
+// Warning - предупреждение по рецепту: противопоказание или аллергия пациента
+type Warning struct {
+	MedicineID int    `json:"medicine_id"`
+	Message    string `json:"message"`
 }
 
+func warningsText(warnings []Warning) string {
+	if len(warnings) == 0 {
+		return ""
+	}
+	lines := []string{"\n\nWarnings:"}
+	for _, warning := range warnings {
+		lines = append(lines, "- "+warning.Message)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// sendQuery выполняет зарегистрированный на сервере именованный запрос.
+// Параметры передаются по именам, сервер сам расставляет их по позициям
+// и проверяет типы (даты - YYYY-MM-DD, списки - массивы строк).
 func sendQuery(query string, params map[string]interface{}) (QueryResult, error) {
 	req := QueryRequest{
 		Query:  query,
@@ -100,8 +206,8 @@ func sendQuery(query string, params map[string]interface{}) (QueryResult, error)
 	return result, nil
 }
 
-func getQueryNames() ([]string, error) {
-	resp, err := http.Get("http://localhost:8000/query_names")
+func getCatalog() ([]CatalogReport, error) {
+	resp, err := http.Get("http://localhost:8000/catalog")
 	if err != nil {
 		return nil, err
 	}
@@ -111,32 +217,38 @@ func getQueryNames() ([]string, error) {
 		return nil, fmt.Errorf("error: status code %d", resp.StatusCode)
 	}
 
-	var names []string
-	if err := json.NewDecoder(resp.Body).Decode(&names); err != nil {
+	var catalog struct {
+		Reports []CatalogReport `json:"reports"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&catalog); err != nil {
 		return nil, err
 	}
 
-	return names, nil
+	return catalog.Reports, nil
 }
 
 func main() {
 	a := app.New()
 	w := a.NewWindow("Pharmacy App")
 
-	queryNames, err := getQueryNames()
+	reports, err := getCatalog()
 	if err != nil {
 		dialog.ShowError(err, w)
 		return
 	}
 
-	buttons := make([]fyne.CanvasObject, len(queryNames))
-	for i, name := range queryNames {
-		queryID := i + 1
-		buttons[i] = widget.NewButton(name, func() {
-			showParameterForm(w, queryID)
+	buttons := make([]fyne.CanvasObject, len(reports))
+	for i, report := range reports {
+		report := report
+		buttons[i] = widget.NewButton(report.Title, func() {
+			showParameterForm(w, report)
 		})
 	}
 
+	createReceiptBtn := widget.NewButton("Create Prescription", func() {
+		showCreateReceiptForm(w)
+	})
+
 	createOrderBtn := widget.NewButton("Create Order", func() {
 		showCreateOrderForm(w)
 	})
@@ -149,16 +261,53 @@ func main() {
 		showEditOrderForm(w)
 	})
 
-	deleteOrderBtn := widget.NewButton("Delete Order", func() {
-		showDeleteOrderForm(w)
+	changeStatusBtn := widget.NewButton("Change Order Status", func() {
+		showChangeOrderStatusForm(w)
+	})
+
+	pickupOrderBtn := widget.NewButton("Pick Up Order", func() {
+		showPickupOrderForm(w)
+	})
+
+	cancelOrderBtn := widget.NewButton("Cancel Order", func() {
+		showCancelOrderForm(w)
+	})
+
+	invoiceBtn := widget.NewButton("Show Invoice", func() {
+		showInvoiceForm(w)
+	})
+
+	paymentBtn := widget.NewButton("Record Payment", func() {
+		showPaymentForm(w)
+	})
+
+	labelBtn := widget.NewButton("Print Label", func() {
+		showPrintLabelForm(w)
+	})
+
+	writeOffBtn := widget.NewButton("Write Off Stock", func() {
+		showWriteOffForm(w)
 	})
 
 	content := container.NewVBox(buttons...)
 	content.Add(widget.NewLabel("Order Management"))
+	content.Add(createReceiptBtn)
 	content.Add(createOrderBtn)
 	content.Add(viewOrdersBtn)
 	content.Add(editOrderBtn)
-	content.Add(deleteOrderBtn)
+	content.Add(changeStatusBtn)
+	content.Add(pickupOrderBtn)
+	content.Add(cancelOrderBtn)
+	content.Add(invoiceBtn)
+	content.Add(paymentBtn)
+	content.Add(labelBtn)
+	content.Add(widget.NewLabel("Warehouse"))
+	content.Add(writeOffBtn)
+
+	alertLabel := widget.NewLabel("No stock alerts")
+	alertLabel.Wrapping = fyne.TextWrapWord
+	content.Add(alertLabel)
+	go watchStockAlerts(alertLabel)
 
 	w.SetContent(content)
 	w.Resize(fyne.NewSize(400, 600))
@@ -166,219 +315,119 @@ func main() {
 	w.ShowAndRun()
 }
 
-func showParameterForm(parent fyne.Window, queryID int) {
-	paramWindow := fyne.CurrentApp().NewWindow("Query parameters")
-	paramEntries := make(map[string]*widget.Entry)
-
-	switch queryID {
-	case 1:
-		queryString := strconv.Itoa(queryID)
-		getQueryResultWithParams(parent, queryString, nil)
-		getQueryResultWithParams(parent, queryString+"_count", nil)
-		paramWindow.Close()
-	case 2:
-		paramEntries["Тип"] = widget.NewEntry()
-		paramEntries["Тип"].SetPlaceHolder("Введите тип медикамента или оставьте поле пустым")
-		formItems := make([]*widget.FormItem, 0, len(paramEntries))
-		for label, entry := range paramEntries {
-			formItems = append(formItems, widget.NewFormItem(label, entry))
-		}
-
-		form := widget.NewForm(formItems...)
-		form.SubmitText = "Выполнить"
-		form.OnSubmit = func() {
-			params := make(map[string]string)
-			for label, entry := range paramEntries {
-				params[label] = entry.Text
-			}
-			if params["Тип"] == "" {
-				queryString := strconv.Itoa(queryID)
-				getQueryResultWithParams(parent, queryString, nil)
-				getQueryResultWithParams(parent, queryString+"_count", nil)
-			} else {
-				getQueryResultWithParams(parent, strconv.Itoa(queryID)+"_type", params)
-				getQueryResultWithParams(parent, strconv.Itoa(queryID)+"_type_count", params)
+// showParameterForm строит форму по параметрам отчёта из каталога. Для
+// отчётов без параметров запросы выполняются сразу.
+func showParameterForm(parent fyne.Window, report CatalogReport) {
+	if len(report.Params) == 0 {
+		runReportQueries(parent, report, nil)
+		return
+	}
+
+	paramWindow := fyne.CurrentApp().NewWindow(report.Title)
+	values := make(map[string]func() string, len(report.Params))
+	formItems := make([]*widget.FormItem, 0, len(report.Params))
+	for _, param := range report.Params {
+		input, value := paramInput(param)
+		values[param.Name] = value
+		formItems = append(formItems, widget.NewFormItem(param.Label, input))
+	}
+
+	form := widget.NewForm(formItems...)
+	form.SubmitText = "Выполнить"
+	form.OnSubmit = func() {
+		filled := make(map[string]string)
+		for name, value := range values {
+			if text := strings.TrimSpace(value()); text != "" {
+				filled[name] = text
 			}
-			paramWindow.Close()
 		}
-		paramWindow.SetContent(form)
-		paramWindow.Resize(fyne.NewSize(500, 200))
-		paramWindow.Show()
-	case 3:
-		paramEntries["Тип"] = widget.NewEntry()
-		paramEntries["Тип"].SetPlaceHolder("Введите тип медикамента или оставьте поле пустым")
-		formItems := make([]*widget.FormItem, 0, len(paramEntries))
-		for label, entry := range paramEntries {
-			formItems = append(formItems, widget.NewFormItem(label, entry))
-		}
-
-		form := widget.NewForm(formItems...)
-		form.SubmitText = "Выполнить"
-		form.OnSubmit = func() {
-			params := make(map[string]string)
-			for label, entry := range paramEntries {
-				params[label] = entry.Text
-			}
-			if params["Тип"] == "" {
-				queryString := strconv.Itoa(queryID)
-				getQueryResultWithParams(parent, queryString, nil)
-			} else {
-				getQueryResultWithParams(parent, strconv.Itoa(queryID)+"_type", params)
-			}
+		if runReportQueries(parent, report, filled) {
 			paramWindow.Close()
 		}
-		paramWindow.SetContent(form)
-		paramWindow.Resize(fyne.NewSize(500, 200))
-		paramWindow.Show()
-	case 4:
-		paramEntries["Вещество"] = widget.NewEntry()
-		paramEntries["Вещество"].SetPlaceHolder("Введите название вещества")
-		paramEntries["Начало периода"] = widget.NewEntry()
-		paramEntries["Начало периода"].SetPlaceHolder("Укажите начало периода")
-		paramEntries["Конец периода"] = widget.NewEntry()
-		paramEntries["Конец периода"].SetPlaceHolder("Укажите конец периода")
-		formItems := make([]*widget.FormItem, 0, len(paramEntries))
-		for label, entry := range paramEntries {
-			formItems = append(formItems, widget.NewFormItem(label, entry))
-		}
-
-		form := widget.NewForm(formItems...)
-		form.SubmitText = "Выполнить"
-		form.OnSubmit = func() {
-			params := make(map[string]string)
-			for label, entry := range paramEntries {
-				params[label] = entry.Text
-			}
-			getQueryResultWithParams(parent, strconv.Itoa(queryID), params)
-			paramWindow.Close()
+	}
+	paramWindow.SetContent(form)
+	paramWindow.Resize(fyne.NewSize(500, 200))
+	paramWindow.Show()
+}
+
+// paramInput возвращает поле ввода для параметра каталога и функцию чтения
+// его значения.
+func paramInput(param CatalogParam) (fyne.CanvasObject, func() string) {
+	switch param.Type {
+	case "medicine_type":
+		selectType := widget.NewSelect(append([]string{""}, medicineTypes...), nil)
+		selectType.PlaceHolder = "Оставьте пустым, чтобы не фильтровать"
+		return selectType, func() string { return selectType.Selected }
+	}
+
+	entry := widget.NewEntry()
+	switch param.Type {
+	case "text_list":
+		entry.SetPlaceHolder("Значения через запятую")
+	case "medicine_type_list":
+		entry.SetPlaceHolder(strings.Join(medicineTypes, ", "))
+	case "date":
+		entry.SetPlaceHolder("YYYY-MM-DD")
+	case "int":
+		entry.SetPlaceHolder("Целое число")
+	}
+	return entry, func() string { return entry.Text }
+}
+
+// runReportQueries выполняет запросы отчёта, для которых заполнены все
+// параметры. Если подходят варианты с разным числом параметров, выполняются
+// самые конкретные из них: при указанном типе - type и type_count вместо
+// основного запроса и count. Возвращает false, если выполнить нечего.
+func runReportQueries(parent fyne.Window, report CatalogReport, filled map[string]string) bool {
+	var selected []CatalogReportQuery
+	for _, query := range report.Queries {
+		if !queryParamsFilled(query, filled) {
+			continue
 		}
-		paramWindow.SetContent(form)
-		paramWindow.Resize(fyne.NewSize(500, 200))
-		paramWindow.Show()
-	case 6:
-		queryString := strconv.Itoa(queryID)
-		getQueryResultWithParams(parent, queryString, nil)
-		paramWindow.Close()
-	case 7:
-		paramEntries["Тип"] = widget.NewEntry()
-		paramEntries["Тип"].SetPlaceHolder("Введите категорию медикамента или оставьте поле пустым")
-		formItems := make([]*widget.FormItem, 0, len(paramEntries))
-		for label, entry := range paramEntries {
-			formItems = append(formItems, widget.NewFormItem(label, entry))
-		}
-
-		form := widget.NewForm(formItems...)
-		form.SubmitText = "Выполнить"
-		form.OnSubmit = func() {
-			params := make(map[string]string)
-			for label, entry := range paramEntries {
-				params[label] = entry.Text
-			}
-			if params["Тип"] == "" {
-				queryString := strconv.Itoa(queryID)
-				getQueryResultWithParams(parent, queryString, nil)
-			} else {
-				getQueryResultWithParams(parent, strconv.Itoa(queryID)+"_type", params)
-			}
-			paramWindow.Close()
+		if len(selected) > 0 && len(query.Params) < len(selected[0].Params) {
+			continue
 		}
-		paramWindow.SetContent(form)
-		paramWindow.Resize(fyne.NewSize(500, 200))
-		paramWindow.Show()
-	case 8:
-		queryString := strconv.Itoa(queryID)
-		getQueryResultWithParams(parent, queryString, nil)
-		getQueryResultWithParams(parent, queryString+"_count", nil)
-		paramWindow.Close()
-	case 9:
-		queryString := strconv.Itoa(queryID)
-		getQueryResultWithParams(parent, queryString, nil)
-		paramWindow.Close()
-	case 10:
-		paramEntries["Тип"] = widget.NewEntry()
-		paramEntries["Тип"].SetPlaceHolder("Введите категорию медикамента или оставьте поле пустым")
-		formItems := make([]*widget.FormItem, 0, len(paramEntries))
-		for label, entry := range paramEntries {
-			formItems = append(formItems, widget.NewFormItem(label, entry))
-		}
-
-		form := widget.NewForm(formItems...)
-		form.SubmitText = "Выполнить"
-		form.OnSubmit = func() {
-			params := make(map[string]string)
-			for label, entry := range paramEntries {
-				params[label] = entry.Text
-			}
-			if params["Тип"] == "" {
-				queryString := strconv.Itoa(queryID)
-				getQueryResultWithParams(parent, queryString, nil)
-			} else {
-				getQueryResultWithParams(parent, strconv.Itoa(queryID)+"_type", params)
-			}
-			paramWindow.Close()
+		if len(selected) > 0 && len(query.Params) > len(selected[0].Params) {
+			selected = nil
 		}
-		paramWindow.SetContent(form)
-		paramWindow.Resize(fyne.NewSize(500, 200))
-		paramWindow.Show()
-	case 12:
-		paramEntries["Тип"] = widget.NewEntry()
-		paramEntries["Тип"].SetPlaceHolder("Введите категорию медикамента")
-		formItems := make([]*widget.FormItem, 0, len(paramEntries))
-		for label, entry := range paramEntries {
-			formItems = append(formItems, widget.NewFormItem(label, entry))
-		}
-
-		form := widget.NewForm(formItems...)
-		form.SubmitText = "Выполнить"
-		form.OnSubmit = func() {
-			params := make(map[string]string)
-			for label, entry := range paramEntries {
-				params[label] = entry.Text
-			}
-			getQueryResultWithParams(parent, strconv.Itoa(queryID)+"_type", params)
-			paramWindow.Close()
+		selected = append(selected, query)
+	}
+
+	if len(selected) == 0 {
+		dialog.ShowError(fmt.Errorf("fill in the report parameters"), parent)
+		return false
+	}
+
+	for _, query := range selected {
+		params := make(map[string]string, len(query.Params))
+		for _, name := range query.Params {
+			params[name] = filled[name]
 		}
-		paramWindow.SetContent(form)
-		paramWindow.Resize(fyne.NewSize(500, 200))
-		paramWindow.Show()
-	case 13:
-		paramEntries["Тип"] = widget.NewEntry()
-		paramEntries["Тип"].SetPlaceHolder("Введите название медикамента")
-		formItems := make([]*widget.FormItem, 0, len(paramEntries))
-		for label, entry := range paramEntries {
-			formItems = append(formItems, widget.NewFormItem(label, entry))
-		}
-
-		form := widget.NewForm(formItems...)
-		form.SubmitText = "Выполнить"
-		form.OnSubmit = func() {
-			params := make(map[string]string)
-			for label, entry := range paramEntries {
-				params[label] = entry.Text
-			}
-			fmt.Printf(params["Тип"])
-			getQueryResultWithParams(parent, strconv.Itoa(queryID)+"_type", params)
-			paramWindow.Close()
+		title := "Отчёт " + report.ID
+		if query.Variant != "" {
+			title += " (" + query.Variant + ")"
 		}
-		paramWindow.SetContent(form)
-		paramWindow.Resize(fyne.NewSize(500, 200))
-		paramWindow.Show()
-	default:
-		dialog.ShowError(fmt.Errorf("unknown query ID"), paramWindow)
-		return
+		getQueryResultWithParams(parent, title, query.Name, params)
 	}
+	return true
 }
 
-func getQueryResultWithParams(parent fyne.Window, queryID string, params map[string]string) {
-	queryParams := ""
-	for key, value := range params {
-		if queryParams != "" {
-			queryParams += "&"
+func queryParamsFilled(query CatalogReportQuery, filled map[string]string) bool {
+	for _, name := range query.Params {
+		if filled[name] == "" {
+			return false
 		}
-		queryParams += fmt.Sprintf("%s=%s", key, value)
+	}
+	return true
+}
+
+func getQueryResultWithParams(parent fyne.Window, title string, queryID string, params map[string]string) {
+	queryParams := url.Values{}
+	for key, value := range params {
+		queryParams.Set(key, value)
 	}
 
-	resp, err := http.Get(fmt.Sprintf("http://localhost:8000/queries/%s?%s", queryID, queryParams))
+	resp, err := http.Get(fmt.Sprintf("http://localhost:8000/queries/%s?%s", queryID, queryParams.Encode()))
 	if err != nil {
 		dialog.ShowError(err, parent)
 		return
@@ -397,10 +446,10 @@ func getQueryResultWithParams(parent fyne.Window, queryID string, params map[str
 		return
 	}
 
-	showResultTable(parent, result)
+	showResultTable(parent, title, result)
 }
 
-func showResultTable(parent fyne.Window, result QueryResult) {
+func showResultTable(parent fyne.Window, title string, result QueryResult) {
 	if len(result.Rows) == 0 {
 		dialog.ShowInformation("Result", "No data found", parent)
 		return
@@ -436,27 +485,120 @@ func showResultTable(parent fyne.Window, result QueryResult) {
 		},
 	)
 
-	resultWindow := fyne.CurrentApp().NewWindow("Query Result")
+	resultWindow := fyne.CurrentApp().NewWindow(title)
 	resultWindow.SetContent(container.NewScroll(resultTable))
 	resultWindow.Resize(fyne.NewSize(1400, 720))
 	resultWindow.CenterOnScreen()
 	resultWindow.Show()
 }
 
+// showCreateReceiptForm создаёт рецепт со строками лекарств. Каждая строка
+// поля "Medicines" имеет вид: <id лекарства> <количество> [способ применения].
+func showCreateReceiptForm(w fyne.Window) {
+	doctorIdEntry := widget.NewEntry()
+	patientIdEntry := widget.NewEntry()
+	medicinesEntry := widget.NewMultiLineEntry()
+	medicinesEntry.SetPlaceHolder("11 1 по 1 ст. ложке 3 раза в день")
+
+	form := &widget.Form{
+		Items: []*widget.FormItem{
+			{Text: "Doctor ID", Widget: doctorIdEntry},
+			{Text: "Patient ID", Widget: patientIdEntry},
+			{Text: "Medicines", Widget: medicinesEntry},
+		},
+	}
+
+	dialog.ShowForm("Create Prescription", "Create", "Cancel", form.Items, func(b bool) {
+		if !b {
+			return
+		}
+		doctorID, err := strconv.Atoi(doctorIdEntry.Text)
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("invalid doctor ID"), w)
+			return
+		}
+		patientID, err := strconv.Atoi(patientIdEntry.Text)
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("invalid patient ID"), w)
+			return
+		}
+
+		receipt := Receipt{DoctorID: doctorID, PatientID: patientID}
+		for _, text := range strings.Split(medicinesEntry.Text, "\n") {
+			fields := strings.Fields(text)
+			if len(fields) == 0 {
+				continue
+			}
+			if len(fields) < 2 {
+				dialog.ShowError(fmt.Errorf("line %q: expected medicine ID and quantity", text), w)
+				return
+			}
+			medicineID, err := strconv.Atoi(fields[0])
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("line %q: invalid medicine ID", text), w)
+				return
+			}
+			quantity, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("line %q: invalid quantity", text), w)
+				return
+			}
+			line := MedicineLine{MedicineID: medicineID, QuantityUsed: quantity}
+			if len(fields) > 2 {
+				dosage := strings.Join(fields[2:], " ")
+				line.Dosage = &dosage
+			}
+			receipt.Medicines = append(receipt.Medicines, line)
+		}
+
+		data, err := json.Marshal(receipt)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		resp, err := http.Post("http://localhost:8000/receipts", "application/json", bytes.NewBuffer(data))
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusUnprocessableEntity {
+			result, err := decodeRuleViolations(resp.Body)
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			showRuleViolations(result, w)
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			dialog.ShowError(fmt.Errorf("error: %s", string(body)), w)
+			return
+		}
+
+		var created Receipt
+		if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		dialog.ShowInformation("Success", fmt.Sprintf("Prescription %d created with %d medicine(s)%s", created.ID, len(created.Medicines), warningsText(append(created.Warnings, created.Allergies...))), w)
+	}, w)
+}
+
 func showCreateOrderForm(w fyne.Window) {
 	customerIdEntry := widget.NewEntry()
 	receiptIdEntry := widget.NewEntry()
-	orderDateEntry := widget.NewEntry()
-	productionDateEntry := widget.NewEntry()
-	statusEntry := widget.NewEntry()
+	approvedByEntry := widget.NewEntry()
+	approvedByEntry.SetPlaceHolder("for restricted medicines")
 
 	form := &widget.Form{
 		Items: []*widget.FormItem{
 			{Text: "Customer ID", Widget: customerIdEntry},
 			{Text: "Receipt ID", Widget: receiptIdEntry},
-			{Text: "Order Date (YYYY-MM-DD)", Widget: orderDateEntry},
-			{Text: "Production Date (YYYY-MM-DD)", Widget: productionDateEntry},
-			{Text: "Status", Widget: statusEntry},
+			{Text: "Approved By", Widget: approvedByEntry},
 		},
 	}
 
@@ -474,45 +616,198 @@ func showCreateOrderForm(w fyne.Window) {
 			dialog.ShowError(fmt.Errorf("invalid receipt ID"), w)
 			return
 		}
-		orderDate, err := time.Parse("2006-01-02", orderDateEntry.Text)
+		// Дата заказа, дата изготовления и статус определяются сервером
+		order := Order{
+			CustomerID: customerID,
+			ReceiptID:  receiptID,
+			ApprovedBy: strings.TrimSpace(approvedByEntry.Text),
+		}
+		submitOrder(order, w)
+	}, w)
+}
+
+// submitOrder отправляет заказ. Если сервер требует подтвердить аллергии
+// пациента, фармацевт видит их и может отправить заказ повторно с
+// подтверждением.
+func submitOrder(order Order, w fyne.Window) {
+	data, err := json.Marshal(order)
+	if err != nil {
+		dialog.ShowError(err, w)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:8000/orders", bytes.NewBuffer(data))
+	if err != nil {
+		dialog.ShowError(err, w)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User", currentUser)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		dialog.ShowError(err, w)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		result, err := decodeRuleViolations(resp.Body)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		allergyIDs, messages := make([]int, 0), make([]string, 0)
+		for _, violation := range result.Violations {
+			if violation.Rule != "allergy" || violation.AllergyID == nil {
+				showRuleViolations(result, w)
+				return
+			}
+			allergyIDs = append(allergyIDs, *violation.AllergyID)
+			messages = append(messages, "- "+violation.Message)
+		}
+		dialog.ShowConfirm("Allergy warning", strings.Join(messages, "\n")+"\n\nAcknowledge and place the order?", func(ok bool) {
+			if ok {
+				order.AcknowledgedAllergies = append(order.AcknowledgedAllergies, allergyIDs...)
+				submitOrder(order, w)
+			}
+		}, w)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		dialog.ShowError(fmt.Errorf("error: %s", string(body)), w)
+		return
+	}
+
+	var created Order
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		dialog.ShowError(err, w)
+		return
+	}
+
+	dialog.ShowInformation("Success", fmt.Sprintf("Order %d created: %s, ready by %s%s", created.ID, created.Status, created.ProductionDate, warningsText(created.Warnings)), w)
+}
+
+// RuleViolations - ответ 422: какие правила проверки рецепта нарушены
+type RuleViolations struct {
+	Error      string `json:"error"`
+	Violations []struct {
+		Rule       string `json:"rule"`
+		Message    string `json:"message"`
+		MedicineID *int   `json:"medicine_id"`
+		AllergyID  *int   `json:"allergy_id"`
+	} `json:"violations"`
+}
+
+func decodeRuleViolations(body io.Reader) (RuleViolations, error) {
+	var result RuleViolations
+	err := json.NewDecoder(body).Decode(&result)
+	return result, err
+}
+
+func showRuleViolations(result RuleViolations, w fyne.Window) {
+	lines := make([]string, 0, len(result.Violations))
+	for _, violation := range result.Violations {
+		lines = append(lines, fmt.Sprintf("- %s (%s)", violation.Message, violation.Rule))
+	}
+	dialog.ShowInformation(result.Error, strings.Join(lines, "\n"), w)
+}
+
+func showPickupOrderForm(w fyne.Window) {
+	orderIdEntry := widget.NewEntry()
+	form := &widget.Form{
+		Items: []*widget.FormItem{
+			{Text: "Order ID", Widget: orderIdEntry},
+		},
+	}
+
+	dialog.ShowForm("Pick Up Order", "Hand Over", "Cancel", form.Items, func(b bool) {
+		if !b {
+			return
+		}
+		orderID, err := strconv.Atoi(orderIdEntry.Text)
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("invalid order ID"), w)
+			return
+		}
+
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost:8000/orders/%d/pickup", orderID), nil)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		req.Header.Set("X-User", currentUser)
+
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
-			dialog.ShowError(fmt.Errorf("invalid order date"), w)
+			dialog.ShowError(err, w)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			dialog.ShowError(fmt.Errorf("error: %s", string(body)), w)
 			return
 		}
-		productionDate, err := time.Parse("2006-01-02", productionDateEntry.Text)
+
+		dialog.ShowInformation("Success", fmt.Sprintf("Order %d handed over", orderID), w)
+	}, w)
+}
+
+func showChangeOrderStatusForm(w fyne.Window) {
+	orderIdEntry := widget.NewEntry()
+	statusSelect := widget.NewSelect(orderStatuses, nil)
+
+	form := &widget.Form{
+		Items: []*widget.FormItem{
+			{Text: "Order ID", Widget: orderIdEntry},
+			{Text: "New Status", Widget: statusSelect},
+		},
+	}
+
+	dialog.ShowForm("Change Order Status", "Apply", "Cancel", form.Items, func(b bool) {
+		if !b {
+			return
+		}
+		orderID, err := strconv.Atoi(orderIdEntry.Text)
 		if err != nil {
-			dialog.ShowError(fmt.Errorf("invalid production date"), w)
+			dialog.ShowError(fmt.Errorf("invalid order ID"), w)
+			return
+		}
+		if statusSelect.Selected == "" {
+			dialog.ShowError(fmt.Errorf("select a status"), w)
 			return
 		}
-		status := statusEntry.Text
 
-		order := map[string]interface{}{
-			"customer_id":     customerID,
-			"receipt_id":      receiptID,
-			"order_date":      orderDate.Format("2006-01-02"),
-			"production_date": productionDate.Format("2006-01-02"),
-			"status":          status,
+		data, err := json.Marshal(map[string]string{"status": statusSelect.Selected})
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
 		}
 
-		data, err := json.Marshal(order)
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost:8000/orders/%d/status", orderID), bytes.NewBuffer(data))
 		if err != nil {
 			dialog.ShowError(err, w)
 			return
 		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-User", currentUser)
 
-		resp, err := http.Post("http://localhost:8000/orders", "application/json", bytes.NewBuffer(data))
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			dialog.ShowError(err, w)
 			return
 		}
 		defer resp.Body.Close()
+
 		if resp.StatusCode != http.StatusOK {
 			body, _ := ioutil.ReadAll(resp.Body)
 			dialog.ShowError(fmt.Errorf("error: %s", string(body)), w)
 			return
 		}
 
-		dialog.ShowInformation("Success", "Order created successfully", w)
+		dialog.ShowInformation("Success", fmt.Sprintf("Order %d is now %s", orderID, statusSelect.Selected), w)
 	}, w)
 }
 
@@ -536,7 +831,7 @@ func showOrders(w fyne.Window) {
 		return
 	}
 
-	showResultTable(w, result)
+	showResultTable(w, "Query Result", result)
 }
 
 func showEditOrderForm(w fyne.Window) {
@@ -557,7 +852,7 @@ func showEditOrderForm(w fyne.Window) {
 			return
 		}
 
-		resp, err := http.Get(fmt.Sprintf("http://localhost:8000/orders/%d", orderID))
+		resp, err := http.Get(fmt.Sprintf("http://localhost:8000/orders/%d?expand=all", orderID))
 		if err != nil {
 			dialog.ShowError(err, w)
 			return
@@ -576,34 +871,19 @@ func showEditOrderForm(w fyne.Window) {
 			return
 		}
 
-		// Fetch customer, patient, doctor, and medicines data
-		showEditCustomerForm(w, order.CustomerID)
-		showEditPatientForm(w, order.ReceiptID)
-		showEditDoctorForm(w, order.ReceiptID)
-		showEditMedicineListForm(w, order.ReceiptID)
+		// Все формы открываются из одного согласованного снимка заказа
+		if order.Customer == nil || order.Patient == nil || order.Doctor == nil {
+			dialog.ShowError(fmt.Errorf("order %d is incomplete", orderID), w)
+			return
+		}
+		showEditCustomerForm(w, *order.Customer)
+		showEditPatientForm(w, *order.Patient)
+		showEditDoctorForm(w, *order.Doctor)
+		showEditMedicineListForm(w, order.ReceiptID, order.Medicines)
 	}, w)
 }
 
-func showEditCustomerForm(w fyne.Window, customerID int) {
-	resp, err := http.Get(fmt.Sprintf("http://localhost:8000/customers/%d", customerID))
-	if err != nil {
-		dialog.ShowError(err, w)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		dialog.ShowError(fmt.Errorf("error: %s", string(body)), w)
-		return
-	}
-
-	var customer Customer
-	if err := json.NewDecoder(resp.Body).Decode(&customer); err != nil {
-		dialog.ShowError(err, w)
-		return
-	}
-
+func showEditCustomerForm(w fyne.Window, customer Customer) {
 	surnameEntry := widget.NewEntry()
 	surnameEntry.SetText(customer.Surname)
 	nameEntry := widget.NewEntry()
@@ -641,7 +921,7 @@ func showEditCustomerForm(w fyne.Window, customerID int) {
 			return
 		}
 
-		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://localhost:8000/customers/%d", customerID), bytes.NewBuffer(data))
+		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://localhost:8000/customers/%d", customer.ID), bytes.NewBuffer(data))
 		if err != nil {
 			dialog.ShowError(err, w)
 			return
@@ -649,7 +929,7 @@ func showEditCustomerForm(w fyne.Window, customerID int) {
 		req.Header.Set("Content-Type", "application/json")
 
 		client := &http.Client{}
-		resp, err = client.Do(req)
+		resp, err := client.Do(req)
 		if err != nil {
 			dialog.ShowError(err, w)
 			return
@@ -666,41 +946,25 @@ func showEditCustomerForm(w fyne.Window, customerID int) {
 	}, w)
 }
 
-func showEditPatientForm(w fyne.Window, receiptID int) {
-	resp, err := http.Get(fmt.Sprintf("http://localhost:8000/receipts/%d/patient", receiptID))
-	if err != nil {
-		dialog.ShowError(err, w)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		dialog.ShowError(fmt.Errorf("error: %s", string(body)), w)
-		return
-	}
-
-	var patient Patient
-	if err := json.NewDecoder(resp.Body).Decode(&patient); err != nil {
-		dialog.ShowError(err, w)
-		return
-	}
-
+func showEditPatientForm(w fyne.Window, patient Patient) {
 	surnameEntry := widget.NewEntry()
 	surnameEntry.SetText(patient.Surname)
 	nameEntry := widget.NewEntry()
 	nameEntry.SetText(patient.Name)
 	middleNameEntry := widget.NewEntry()
 	middleNameEntry.SetText(patient.MiddleName)
-	birthdayEntry := widget.NewEntry()
-	birthdayEntry.SetText(patient.Birthday)
+	ageEntry := widget.NewEntry()
+	ageEntry.SetText(strconv.Itoa(patient.Age))
+	diagnosisEntry := widget.NewEntry()
+	diagnosisEntry.SetText(patient.Diagnosis)
 
 	form := &widget.Form{
 		Items: []*widget.FormItem{
 			{Text: "Surname", Widget: surnameEntry},
 			{Text: "Name", Widget: nameEntry},
 			{Text: "Middle Name", Widget: middleNameEntry},
-			{Text: "Birthday", Widget: birthdayEntry},
+			{Text: "Age", Widget: ageEntry},
+			{Text: "Diagnosis", Widget: diagnosisEntry},
 		},
 	}
 
@@ -710,8 +974,14 @@ func showEditPatientForm(w fyne.Window, receiptID int) {
 		}
 		patient.Surname = surnameEntry.Text
 		patient.Name = nameEntry.Text
+		age, err := strconv.Atoi(ageEntry.Text)
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("invalid age"), w)
+			return
+		}
 		patient.MiddleName = middleNameEntry.Text
-		patient.Birthday = birthdayEntry.Text
+		patient.Age = age
+		patient.Diagnosis = diagnosisEntry.Text
 
 		data, err := json.Marshal(patient)
 		if err != nil {
@@ -727,7 +997,7 @@ func showEditPatientForm(w fyne.Window, receiptID int) {
 		req.Header.Set("Content-Type", "application/json")
 
 		client := &http.Client{}
-		resp, err = client.Do(req)
+		resp, err := client.Do(req)
 		if err != nil {
 			dialog.ShowError(err, w)
 			return
@@ -744,41 +1014,19 @@ func showEditPatientForm(w fyne.Window, receiptID int) {
 	}, w)
 }
 
-func showEditDoctorForm(w fyne.Window, receiptID int) {
-	resp, err := http.Get(fmt.Sprintf("http://localhost:8000/receipts/%d/doctor", receiptID))
-	if err != nil {
-		dialog.ShowError(err, w)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		dialog.ShowError(fmt.Errorf("error: %s", string(body)), w)
-		return
-	}
-
-	var doctor Doctor
-	if err := json.NewDecoder(resp.Body).Decode(&doctor); err != nil {
-		dialog.ShowError(err, w)
-		return
-	}
-
+func showEditDoctorForm(w fyne.Window, doctor Doctor) {
 	surnameEntry := widget.NewEntry()
 	surnameEntry.SetText(doctor.Surname)
 	nameEntry := widget.NewEntry()
 	nameEntry.SetText(doctor.Name)
 	middleNameEntry := widget.NewEntry()
 	middleNameEntry.SetText(doctor.MiddleName)
-	specialtyEntry := widget.NewEntry()
-	specialtyEntry.SetText(doctor.Specialty)
 
 	form := &widget.Form{
 		Items: []*widget.FormItem{
 			{Text: "Surname", Widget: surnameEntry},
 			{Text: "Name", Widget: nameEntry},
 			{Text: "Middle Name", Widget: middleNameEntry},
-			{Text: "Specialty", Widget: specialtyEntry},
 		},
 	}
 
@@ -789,7 +1037,6 @@ func showEditDoctorForm(w fyne.Window, receiptID int) {
 		doctor.Surname = surnameEntry.Text
 		doctor.Name = nameEntry.Text
 		doctor.MiddleName = middleNameEntry.Text
-		doctor.Specialty = specialtyEntry.Text
 
 		data, err := json.Marshal(doctor)
 		if err != nil {
@@ -805,7 +1052,7 @@ func showEditDoctorForm(w fyne.Window, receiptID int) {
 		req.Header.Set("Content-Type", "application/json")
 
 		client := &http.Client{}
-		resp, err = client.Do(req)
+		resp, err := client.Do(req)
 		if err != nil {
 			dialog.ShowError(err, w)
 			return
@@ -822,35 +1069,16 @@ func showEditDoctorForm(w fyne.Window, receiptID int) {
 	}, w)
 }
 
-func showEditMedicineListForm(w fyne.Window, receiptID int) {
-	resp, err := http.Get(fmt.Sprintf("http://localhost:8000/receipts/%d/medicines", receiptID))
-	if err != nil {
-		dialog.ShowError(err, w)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		dialog.ShowError(fmt.Errorf("error: %s", string(body)), w)
-		return
-	}
-
-	var medicines []Medicine
-	if err := json.NewDecoder(resp.Body).Decode(&medicines); err != nil {
-		dialog.ShowError(err, w)
-		return
-	}
-
+func showEditMedicineListForm(w fyne.Window, receiptID int, medicines []MedicineLine) {
 	medicineEntries := make([]*widget.Entry, len(medicines))
 	formItems := make([]*widget.FormItem, len(medicines))
 
 	for i, medicine := range medicines {
 		entry := widget.NewEntry()
-		entry.SetText(medicine.Name)
+		entry.SetText(strconv.FormatFloat(medicine.QuantityUsed, 'f', -1, 64))
 		medicineEntries[i] = entry
 		formItems[i] = &widget.FormItem{
-			Text:   fmt.Sprintf("Medicine %d", i+1),
+			Text:   fmt.Sprintf("%s (%s)", medicine.Name, medicine.Type),
 			Widget: entry,
 		}
 	}
@@ -864,7 +1092,12 @@ func showEditMedicineListForm(w fyne.Window, receiptID int) {
 			return
 		}
 		for i, entry := range medicineEntries {
-			medicines[i].Name = entry.Text
+			quantity, err := strconv.ParseFloat(entry.Text, 64)
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("invalid quantity for %s", medicines[i].Name), w)
+				return
+			}
+			medicines[i].QuantityUsed = quantity
 		}
 
 		data, err := json.Marshal(medicines)
@@ -881,7 +1114,7 @@ func showEditMedicineListForm(w fyne.Window, receiptID int) {
 		req.Header.Set("Content-Type", "application/json")
 
 		client := &http.Client{}
-		resp, err = client.Do(req)
+		resp, err := client.Do(req)
 		if err != nil {
 			dialog.ShowError(err, w)
 			return
@@ -898,7 +1131,7 @@ func showEditMedicineListForm(w fyne.Window, receiptID int) {
 	}, w)
 }
 
-func showDeleteOrderForm(w fyne.Window) {
+func showCancelOrderForm(w fyne.Window) {
 	orderIdEntry := widget.NewEntry()
 	form := &widget.Form{
 		Items: []*widget.FormItem{
@@ -906,7 +1139,7 @@ func showDeleteOrderForm(w fyne.Window) {
 		},
 	}
 
-	dialog.ShowForm("Delete Order", "Delete", "Cancel", form.Items, func(b bool) {
+	dialog.ShowForm("Cancel Order", "Cancel Order", "Close", form.Items, func(b bool) {
 		if !b {
 			return
 		}
@@ -921,6 +1154,7 @@ func showDeleteOrderForm(w fyne.Window) {
 			dialog.ShowError(err, w)
 			return
 		}
+		req.Header.Set("X-User", currentUser)
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			dialog.ShowError(err, w)
@@ -934,6 +1168,421 @@ func showDeleteOrderForm(w fyne.Window) {
 			return
 		}
 
-		dialog.ShowInformation("Success", "Order deleted successfully", w)
+		dialog.ShowInformation("Success", "Order cancelled successfully", w)
+	}, w)
+}
+
+type Invoice struct {
+	OrderID  int     `json:"order_id"`
+	Final    bool    `json:"final"`
+	IssuedAt *string `json:"issued_at"`
+	Lines    []struct {
+		Name          string  `json:"name"`
+		Quantity      float64 `json:"quantity"`
+		UnitPrice     float64 `json:"unit_price"`
+		ProductionFee float64 `json:"production_fee"`
+		Amount        float64 `json:"amount"`
+	} `json:"lines"`
+	GoodsTotal      float64 `json:"goods_total"`
+	ProductionTotal float64 `json:"production_total"`
+	Total           float64 `json:"total"`
+}
+
+func showInvoiceForm(w fyne.Window) {
+	orderIdEntry := widget.NewEntry()
+	form := &widget.Form{
+		Items: []*widget.FormItem{
+			{Text: "Order ID", Widget: orderIdEntry},
+		},
+	}
+
+	dialog.ShowForm("Invoice", "Show", "Cancel", form.Items, func(b bool) {
+		if !b {
+			return
+		}
+		orderID, err := strconv.Atoi(orderIdEntry.Text)
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("invalid order ID"), w)
+			return
+		}
+
+		resp, err := http.Get(fmt.Sprintf("http://localhost:8000/orders/%d/invoice", orderID))
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			dialog.ShowError(fmt.Errorf("error: %s", string(body)), w)
+			return
+		}
+
+		var invoice Invoice
+		if err := json.NewDecoder(resp.Body).Decode(&invoice); err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		lines := make([]string, 0, len(invoice.Lines)+4)
+		for _, line := range invoice.Lines {
+			text := fmt.Sprintf("%s: %v x %.2f", line.Name, line.Quantity, line.UnitPrice)
+			if line.ProductionFee > 0 {
+				text += fmt.Sprintf(" + %.2f production", line.ProductionFee)
+			}
+			lines = append(lines, fmt.Sprintf("%s = %.2f", text, line.Amount))
+		}
+		lines = append(lines, "",
+			fmt.Sprintf("Goods: %.2f", invoice.GoodsTotal),
+			fmt.Sprintf("Production: %.2f", invoice.ProductionTotal),
+			fmt.Sprintf("Total: %.2f", invoice.Total))
+		title := fmt.Sprintf("Order %d invoice (estimate)", invoice.OrderID)
+		if invoice.Final && invoice.IssuedAt != nil {
+			title = fmt.Sprintf("Order %d invoice, issued %s", invoice.OrderID, *invoice.IssuedAt)
+		}
+		dialog.ShowInformation(title, strings.Join(lines, "\n"), w)
+	}, w)
+}
+
+// showPaymentForm принимает оплату или предоплату по заказу и показывает
+// остаток к оплате.
+func showPaymentForm(w fyne.Window) {
+	orderIdEntry := widget.NewEntry()
+	methodSelect := widget.NewSelect(paymentMethods, nil)
+	methodSelect.SetSelected("cash")
+	amountEntry := widget.NewEntry()
+	commentEntry := widget.NewEntry()
+
+	form := &widget.Form{
+		Items: []*widget.FormItem{
+			{Text: "Order ID", Widget: orderIdEntry},
+			{Text: "Method", Widget: methodSelect},
+			{Text: "Amount", Widget: amountEntry},
+			{Text: "Comment", Widget: commentEntry},
+		},
+	}
+
+	dialog.ShowForm("Record Payment", "Pay", "Cancel", form.Items, func(b bool) {
+		if !b {
+			return
+		}
+		orderID, err := strconv.Atoi(orderIdEntry.Text)
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("invalid order ID"), w)
+			return
+		}
+		amount, err := strconv.ParseFloat(strings.TrimSpace(amountEntry.Text), 64)
+		if err != nil || amount <= 0 {
+			dialog.ShowError(fmt.Errorf("invalid amount"), w)
+			return
+		}
+
+		payment := map[string]interface{}{
+			"method": methodSelect.Selected,
+			"amount": amount,
+		}
+		if comment := strings.TrimSpace(commentEntry.Text); comment != "" {
+			payment["comment"] = comment
+		}
+		data, err := json.Marshal(payment)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost:8000/orders/%d/payments", orderID), bytes.NewBuffer(data))
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-User", currentUser)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			body, _ := ioutil.ReadAll(resp.Body)
+			dialog.ShowError(fmt.Errorf("error: %s", string(body)), w)
+			return
+		}
+
+		var balance struct {
+			Total      float64 `json:"total"`
+			Paid       float64 `json:"paid"`
+			Refunded   float64 `json:"refunded"`
+			BalanceDue float64 `json:"balance_due"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&balance); err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		dialog.ShowInformation("Success", fmt.Sprintf("Order %d: total %.2f, paid %.2f, balance due %.2f",
+			orderID, balance.Total, balance.Paid-balance.Refunded, balance.BalanceDue), w)
+	}, w)
+}
+
+// showPrintLabelForm получает с сервера этикетки лекарств аптечного
+// изготовления заказа (или одной строки рецепта) и печатает их (ZPL - на
+// принтер этикеток labelPrinter, текст - командой printCommand) или
+// сохраняет в файл.
+func showPrintLabelForm(w fyne.Window) {
+	orderIdEntry := widget.NewEntry()
+	receiptIdEntry := widget.NewEntry()
+	receiptIdEntry.SetPlaceHolder("вместо заказа")
+	lineIdEntry := widget.NewEntry()
+	formatSelect := widget.NewSelect([]string{"zpl", "text"}, nil)
+	formatSelect.SetSelected("zpl")
+	outputSelect := widget.NewSelect([]string{"printer", "file"}, nil)
+	outputSelect.SetSelected("printer")
+
+	form := &widget.Form{
+		Items: []*widget.FormItem{
+			{Text: "Order ID", Widget: orderIdEntry},
+			{Text: "Receipt ID", Widget: receiptIdEntry},
+			{Text: "Receipt Line ID", Widget: lineIdEntry},
+			{Text: "Format", Widget: formatSelect},
+			{Text: "Send To", Widget: outputSelect},
+		},
+	}
+
+	dialog.ShowForm("Print Label", "OK", "Cancel", form.Items, func(b bool) {
+		if !b {
+			return
+		}
+
+		var url string
+		if strings.TrimSpace(receiptIdEntry.Text) != "" {
+			receiptID, err := strconv.Atoi(strings.TrimSpace(receiptIdEntry.Text))
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("invalid receipt ID"), w)
+				return
+			}
+			lineID, err := strconv.Atoi(strings.TrimSpace(lineIdEntry.Text))
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("invalid receipt line ID"), w)
+				return
+			}
+			url = fmt.Sprintf("http://localhost:8000/receipts/%d/medicines/%d/label?format=%s", receiptID, lineID, formatSelect.Selected)
+		} else {
+			orderID, err := strconv.Atoi(strings.TrimSpace(orderIdEntry.Text))
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("invalid order ID"), w)
+				return
+			}
+			url = fmt.Sprintf("http://localhost:8000/orders/%d/labels?format=%s", orderID, formatSelect.Selected)
+		}
+
+		resp, err := http.Get(url)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			dialog.ShowError(fmt.Errorf("error: %s", string(body)), w)
+			return
+		}
+
+		if outputSelect.Selected == "printer" {
+			if err := printLabels(formatSelect.Selected, body); err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			dialog.ShowInformation("Success", "Label sent to the printer", w)
+			return
+		}
+
+		save := dialog.NewFileSave(func(writer fyne.URIWriteCloser, err error) {
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			if writer == nil {
+				return
+			}
+			defer writer.Close()
+			if _, err := writer.Write(body); err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			dialog.ShowInformation("Success", "Label saved to "+writer.URI().Path(), w)
+		}, w)
+		if formatSelect.Selected == "text" {
+			save.SetFileName("label.txt")
+		} else {
+			save.SetFileName("label.zpl")
+		}
+		save.Show()
+	}, w)
+}
+
+// printLabels отправляет ZPL на принтер этикеток по TCP, а текст - на вход
+// команды печати.
+func printLabels(format string, body []byte) error {
+	if format == "zpl" {
+		if labelPrinter == "" {
+			return fmt.Errorf("label printer is not configured, set PHARMACY_LABEL_PRINTER=host:port or save the label to a file")
+		}
+		conn, err := net.DialTimeout("tcp", labelPrinter, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Write(body)
+		return err
+	}
+
+	command := strings.Fields(printCommand)
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v %s", printCommand, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// showWriteOffForm списывает партию лекарства или вещества (номер партии
+// берётся из отчёта 14). Пустое количество - списать весь остаток.
+func showWriteOffForm(w fyne.Window) {
+	kindSelect := widget.NewSelect([]string{"medicine", "substance"}, nil)
+	kindSelect.SetSelected("medicine")
+	lotIdEntry := widget.NewEntry()
+	quantityEntry := widget.NewEntry()
+	quantityEntry.SetPlaceHolder("Пусто - весь остаток партии")
+	reasonSelect := widget.NewSelect(writeOffReasons, nil)
+	commentEntry := widget.NewEntry()
+
+	form := &widget.Form{
+		Items: []*widget.FormItem{
+			{Text: "Lot Kind", Widget: kindSelect},
+			{Text: "Lot ID", Widget: lotIdEntry},
+			{Text: "Quantity", Widget: quantityEntry},
+			{Text: "Reason", Widget: reasonSelect},
+			{Text: "Comment", Widget: commentEntry},
+		},
+	}
+
+	dialog.ShowForm("Write Off Stock", "Write Off", "Cancel", form.Items, func(b bool) {
+		if !b {
+			return
+		}
+		lotID, err := strconv.Atoi(lotIdEntry.Text)
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("invalid lot ID"), w)
+			return
+		}
+		if reasonSelect.Selected == "" {
+			dialog.ShowError(fmt.Errorf("select a reason"), w)
+			return
+		}
+
+		writeOff := map[string]interface{}{
+			kindSelect.Selected + "_lot_id": lotID,
+			"reason":                        reasonSelect.Selected,
+		}
+		if quantityEntry.Text != "" {
+			quantity, err := strconv.ParseFloat(quantityEntry.Text, 64)
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("invalid quantity"), w)
+				return
+			}
+			writeOff["quantity"] = quantity
+		}
+		if commentEntry.Text != "" {
+			writeOff["comment"] = commentEntry.Text
+		}
+
+		data, err := json.Marshal(writeOff)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:8000/write_offs", bytes.NewBuffer(data))
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-User", currentUser)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated {
+			body, _ := ioutil.ReadAll(resp.Body)
+			dialog.ShowError(fmt.Errorf("error: %s", string(body)), w)
+			return
+		}
+
+		dialog.ShowInformation("Success", fmt.Sprintf("Lot %d written off", lotID), w)
 	}, w)
 }
+
+type StockAlert struct {
+	Kind            string  `json:"kind"`
+	Name            string  `json:"name"`
+	AvailableAmount float64 `json:"available_amount"`
+	CriticalLimit   float64 `json:"critical_limit"`
+	At              string  `json:"at"`
+}
+
+// watchStockAlerts слушает поток /alerts/stream и показывает уведомления
+// о критическом остатке; при обрыве соединения переподключается.
+func watchStockAlerts(label *widget.Label) {
+	for {
+		err := readStockAlerts(func(alert StockAlert) {
+			message := fmt.Sprintf("%s %s: %s осталось %.2f (норма %.0f)",
+				alert.At, alert.Kind, alert.Name, alert.AvailableAmount, alert.CriticalLimit)
+			label.SetText(message)
+			fyne.CurrentApp().SendNotification(fyne.NewNotification("Critical stock", message))
+		})
+		if err != nil {
+			label.SetText(fmt.Sprintf("Stock alerts unavailable: %v", err))
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func readStockAlerts(onAlert func(StockAlert)) error {
+	resp, err := http.Get("http://localhost:8000/alerts/stream")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var alert StockAlert
+		if err := json.Unmarshal([]byte(data), &alert); err != nil {
+			continue
+		}
+		onAlert(alert)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed")
+}